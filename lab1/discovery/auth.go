@@ -0,0 +1,134 @@
+package discovery
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMaxSkew = 30 * time.Second
+
+	nonceLen = 12
+	macLen   = sha256.Size
+	// macTrailerLen is the size of the MAC field, which must close the
+	// datagram so that it can cover every byte before it.
+	macTrailerLen = 3 + macLen
+	authOverhead  = 3 + 8 + 3 + nonceLen + macTrailerLen
+	minKeyLen     = 16
+)
+
+var (
+	errUnauthenticated = errors.New("missing or invalid authentication")
+	errReplayed        = errors.New("replayed datagram")
+	errStale           = errors.New("stale datagram")
+)
+
+func LoadKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key := bytes.TrimSpace(data)
+	if len(key) < minKeyLen {
+		return nil, fmt.Errorf("key in %q is too short: %d bytes, want at least %d", path, len(key), minKeyLen)
+	}
+	return key, nil
+}
+
+type nonceKey struct {
+	id    NodeID
+	nonce [nonceLen]byte
+}
+
+// authenticator signs outgoing datagrams with HMAC-SHA256 and rejects
+// incoming ones that are unsigned, forged, too far from our clock or
+// already seen. Nonces are remembered for twice the allowed skew, after
+// which the timestamp check alone rejects a replay.
+type authenticator struct {
+	key     []byte
+	maxSkew time.Duration
+
+	mu        sync.Mutex
+	seen      map[nonceKey]time.Time
+	lastPrune time.Time
+}
+
+func newAuthenticator(key []byte, maxSkew time.Duration) *authenticator {
+	return &authenticator{
+		key:     key,
+		maxSkew: maxSkew,
+		seen:    make(map[nonceKey]time.Time),
+	}
+}
+
+func (a *authenticator) seal(msg []byte, now time.Time) ([]byte, error) {
+	var nonce [nonceLen]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, len(msg)+authOverhead)
+	out = append(out, msg...)
+	out = appendTimeTLV(out, tagAuthTime, now)
+	out = append(out, tagNonce)
+	out = binary.BigEndian.AppendUint16(out, nonceLen)
+	out = append(out, nonce[:]...)
+
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write(out)
+	out = append(out, tagMAC)
+	out = binary.BigEndian.AppendUint16(out, macLen)
+	return mac.Sum(out), nil
+}
+
+func (a *authenticator) open(data []byte, now time.Time) (heartbeat, error) {
+	var hb heartbeat
+	if len(data) < 4 || string(data[:4]) != heartbeatMagic {
+		return hb, errForeign
+	}
+	n := len(data) - macTrailerLen
+	if n < headerLen || data[n] != tagMAC || binary.BigEndian.Uint16(data[n+1:n+3]) != macLen {
+		return hb, errUnauthenticated
+	}
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write(data[:n])
+	if !hmac.Equal(mac.Sum(nil), data[n+3:]) {
+		return hb, errUnauthenticated
+	}
+
+	if err := hb.UnmarshalBinary(data); err != nil {
+		return hb, err
+	}
+	if hb.AuthTime.IsZero() || hb.Nonce == nil || len(hb.Nonce) != nonceLen {
+		return hb, errUnauthenticated
+	}
+	if skew := now.Sub(hb.AuthTime); skew > a.maxSkew || skew < -a.maxSkew {
+		return hb, fmt.Errorf("%w: clock differs by %s", errStale, skew.Round(time.Millisecond))
+	}
+
+	key := nonceKey{id: hb.NodeID}
+	copy(key.nonce[:], hb.Nonce)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if now.Sub(a.lastPrune) > a.maxSkew {
+		for k, t := range a.seen {
+			if now.Sub(t) > 2*a.maxSkew {
+				delete(a.seen, k)
+			}
+		}
+		a.lastPrune = now
+	}
+	if _, dup := a.seen[key]; dup {
+		return hb, errReplayed
+	}
+	a.seen[key] = now
+	return hb, nil
+}
@@ -0,0 +1,79 @@
+package discovery
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestAuthRejections feeds a node with a key datagrams that are unsigned,
+// forged, replayed or too far from its clock, and checks that each is
+// rejected for the right reason and counted as such.
+func TestAuthRejections(t *testing.T) {
+	const skew = 10 * time.Second
+	key := []byte("0123456789abcdef")
+	clock := newSimClock()
+	cfg := testConfig(t, testGroups[0].group)
+	cfg.Key = key
+	cfg.MaxClockSkew = skew
+	cfg.Clock = clock
+	cfg.NodeID = NodeID{0: 9}
+	d, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sender := newAuthenticator(key, skew)
+	forger := newAuthenticator([]byte("fedcba9876543210"), skew)
+	hb := heartbeat{Type: msgHeartbeat, NodeID: NodeID{0: 1}, Start: clock.Now(), Hostname: "peer"}
+	msg, err := hb.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seal := func(a *authenticator, at time.Time) []byte {
+		t.Helper()
+		out, err := a.seal(msg, at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+	now := clock.Now()
+	valid := seal(sender, now)
+	tampered := seal(sender, now)
+	tampered[len(msg)-1] ^= 1
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"valid", valid, nil},
+		{"unsigned", msg, errUnauthenticated},
+		{"forged", seal(forger, now), errUnauthenticated},
+		{"tampered", tampered, errUnauthenticated},
+		{"replayed", valid, errReplayed},
+		{"old", seal(sender, now.Add(-skew-time.Second)), errStale},
+		{"early", seal(sender, now.Add(skew+time.Second)), errStale},
+		{"within skew", seal(sender, now.Add(-skew+time.Second)), nil},
+	} {
+		got, err := d.decode(tc.data)
+		if !errors.Is(err, tc.want) || (tc.want == nil) != (err == nil) {
+			t.Errorf("%s: %v, want %v", tc.name, err, tc.want)
+			continue
+		}
+		if err != nil {
+			d.countDrop(err)
+		} else if got.NodeID != hb.NodeID || got.Hostname != hb.Hostname {
+			t.Errorf("%s: opened as %+v", tc.name, got)
+		}
+	}
+
+	want := Stats{Unauthenticated: 3, Replayed: 1, Stale: 2}
+	if st := d.Stats(); st != want {
+		t.Errorf("stats %+v, want %+v", st, want)
+	}
+	if n := d.Stats().Rejected(); n != 6 {
+		t.Errorf("%d rejected, want 6", n)
+	}
+}
@@ -0,0 +1,350 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+func isV6(addr *net.UDPAddr) bool {
+	return addr.IP.To4() == nil
+}
+
+type listener struct {
+	group *net.UDPAddr
+	// sources turns the any-source join into source-specific joins of
+	// every (source, group) channel; only listed senders are accepted.
+	sources []net.IP
+	conn    PacketConn
+	joined  map[int]net.Interface
+}
+
+func listenGroup(tr Transport, group *net.UDPAddr, sources []net.IP) (*listener, error) {
+	conn, err := tr.Listen(isV6(group), group.String())
+	if err != nil {
+		return nil, fmt.Errorf("listen %s: %w", group, err)
+	}
+	l := &listener{group: group, conn: conn, joined: make(map[int]net.Interface)}
+	for _, src := range sources {
+		if (src.To4() == nil) == isV6(group) {
+			l.sources = append(l.sources, src)
+		}
+	}
+	return l, nil
+}
+
+func (l *listener) join(ifi *net.Interface) error {
+	if len(l.sources) == 0 {
+		return l.conn.JoinGroup(ifi, l.group)
+	}
+	for i, src := range l.sources {
+		if err := l.conn.JoinSourceSpecificGroup(ifi, l.group, &net.IPAddr{IP: src}); err != nil {
+			for _, joined := range l.sources[:i] {
+				l.conn.LeaveSourceSpecificGroup(ifi, l.group, &net.IPAddr{IP: joined})
+			}
+			return fmt.Errorf("source %s: %w", src, err)
+		}
+	}
+	return nil
+}
+
+func (l *listener) leave(ifi *net.Interface) {
+	if len(l.sources) == 0 {
+		l.conn.LeaveGroup(ifi, l.group)
+		return
+	}
+	for _, src := range l.sources {
+		l.conn.LeaveSourceSpecificGroup(ifi, l.group, &net.IPAddr{IP: src})
+	}
+}
+
+// channel names the multicast channel a datagram from src arrived on, or
+// returns "" for any-source groups.
+func (l *listener) channel(src net.IP) (string, bool) {
+	if len(l.sources) == 0 {
+		return "", true
+	}
+	for _, s := range l.sources {
+		if s.Equal(src) {
+			return fmt.Sprintf("(%s, %s)", s, l.group), true
+		}
+	}
+	return "", false
+}
+
+func (l *listener) sync(ifaces map[int]ifaceInfo) {
+	v6 := isV6(l.group)
+	for idx, ifi := range ifaces {
+		if _, ok := l.joined[idx]; ok || !ifi.has(v6) {
+			continue
+		}
+		if err := l.join(&ifi.Interface); err != nil {
+			log.Printf("discovery: join %s on %s: %v", l.group, ifi.Name, err)
+			continue
+		}
+		l.joined[idx] = ifi.Interface
+	}
+	for idx, ifi := range l.joined {
+		if cur, ok := ifaces[idx]; ok && cur.has(v6) {
+			continue
+		}
+		// The interface may already be gone, so leaving is best effort.
+		l.leave(&ifi)
+		delete(l.joined, idx)
+	}
+}
+
+func (d *Discovery) reader(l *listener, ch chan<- packet) {
+	d.readLoop(l.conn, func(hb heartbeat, src *net.UDPAddr, ifIndex int) {
+		channel, ok := l.channel(src.IP)
+		if !ok {
+			d.countDrop(errUnlistedSource)
+			return
+		}
+		// Our own datagrams come back whenever multicast loopback is on,
+		// and once per interface we send on; they are never a peer.
+		if hb.NodeID == d.self.NodeID {
+			if !hb.Start.Equal(d.self.Start) {
+				d.reportDuplicateID(hb, src)
+			}
+			return
+		}
+		switch hb.Type {
+		case msgHeartbeat, msgGoodbye:
+		case msgSolicit:
+			if !d.cfg.Passive {
+				d.answerSolicit(src)
+			}
+			return
+		default:
+			d.countDrop(errMalformed)
+			return
+		}
+		d.enqueue(ch, packet{hb: hb, src: src, group: l.group, channel: channel, ifIndex: ifIndex})
+	})
+}
+
+func (d *Discovery) readLoop(conn PacketConn, handle func(hb heartbeat, src *net.UDPAddr, ifIndex int)) {
+	buf := make([]byte, maxDatagram)
+	for {
+		n, ifIndex, src, err := conn.ReadPacket(buf)
+		if err != nil {
+			if !d.isStopped() {
+				log.Println("discovery reader:", err)
+			}
+			return
+		}
+		udp, ok := src.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		hb, err := d.decode(buf[:n])
+		if err != nil {
+			d.countDrop(err)
+			continue
+		}
+		handle(hb, udp, ifIndex)
+	}
+}
+
+func (d *Discovery) enqueue(ch chan<- packet, pkt packet) {
+	select {
+	case ch <- pkt:
+	default:
+		d.drops.overflow.Add(1)
+		d.metrics.dropped.WithLabelValues("overflow").Inc()
+	}
+}
+
+type groupSender struct {
+	// mu keeps the multicast interface selection and the writes that rely
+	// on it together when several goroutines broadcast.
+	mu     sync.Mutex
+	v6     bool
+	conn   PacketConn
+	groups []*net.UDPAddr
+	// failing remembers which group/interface pairs are erroring so that a
+	// route that is permanently missing is only logged once.
+	failing map[string]bool
+}
+
+func (s *groupSender) report(key string, err error) {
+	if err == nil {
+		if s.failing[key] {
+			log.Printf("sender %s: recovered", key)
+			delete(s.failing, key)
+		}
+		return
+	}
+	if !s.failing[key] {
+		log.Printf("sender %s: %v", key, err)
+		s.failing[key] = true
+	}
+}
+
+// openSenders opens one unbound socket per address family that is used to
+// send heartbeats to every group of that family.
+func openSenders(tr Transport, cfg *Config) ([]*groupSender, error) {
+	groups := cfg.Groups
+	var senders []*groupSender
+	byFamily := make(map[bool]*groupSender)
+	for _, group := range groups {
+		v6 := isV6(group)
+		s, ok := byFamily[v6]
+		if !ok {
+			laddr := "0.0.0.0:0"
+			if v6 {
+				laddr = "[::]:0"
+			}
+			conn, err := tr.Listen(v6, laddr)
+			if err != nil {
+				for _, s := range senders {
+					s.conn.Close()
+				}
+				return nil, fmt.Errorf("sender listen: %w", err)
+			}
+			if err := configureSender(conn, cfg); err != nil {
+				conn.Close()
+				for _, s := range senders {
+					s.conn.Close()
+				}
+				return nil, err
+			}
+			s = &groupSender{v6: v6, conn: conn, failing: make(map[string]bool)}
+			byFamily[v6] = s
+			senders = append(senders, s)
+		}
+		s.groups = append(s.groups, group)
+	}
+	return senders, nil
+}
+
+func configureSender(conn PacketConn, cfg *Config) error {
+	if cfg.MulticastTTL > 0 {
+		if err := conn.SetMulticastHops(cfg.MulticastTTL); err != nil {
+			return fmt.Errorf("set multicast ttl %d: %w", cfg.MulticastTTL, err)
+		}
+	}
+	if err := conn.SetMulticastLoopback(!cfg.DisableLoopback); err != nil {
+		return fmt.Errorf("set multicast loopback: %w", err)
+	}
+	return nil
+}
+
+// reportDuplicateID warns once per foreign incarnation that another process
+// is sending with our node id, typically because the id file was copied
+// from another host.
+func (d *Discovery) reportDuplicateID(hb heartbeat, src *net.UDPAddr) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.dupStarts == nil {
+		d.dupStarts = make(map[time.Time]bool)
+	}
+	if d.dupStarts[hb.Start] {
+		return
+	}
+	d.dupStarts[hb.Start] = true
+	log.Printf("discovery: %s also uses our node id %s; give each node its own id file", src, hb.NodeID)
+}
+
+func (d *Discovery) sender(ctx context.Context) {
+	ticker := d.clock.NewTicker(d.cfg.Interval)
+	defer ticker.Stop()
+
+	var echo <-chan time.Time
+	if d.cfg.EchoInterval > 0 {
+		t := d.clock.NewTicker(d.cfg.EchoInterval)
+		defer t.Stop()
+		echo = t.C()
+	}
+
+	self := d.self
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-echo:
+			d.sendEchoRequests()
+			continue
+		case <-ticker.C():
+		}
+		self.Seq = d.seq.Add(1)
+		self.Election = d.ballot()
+		msg, err := self.MarshalBinary()
+		if err != nil {
+			log.Println("sender encode:", err)
+			continue
+		}
+		d.broadcast(msg)
+	}
+}
+
+// broadcast sends msg to every group out of every selected interface, so
+// that peers on segments other than the default route also hear it.
+func (d *Discovery) broadcast(msg []byte) {
+	ifaces := d.interfaceList()
+	for _, s := range d.senders {
+		s.mu.Lock()
+		for _, ifi := range ifaces {
+			if !ifi.has(s.v6) {
+				continue
+			}
+			if err := s.conn.SetMulticastInterface(&ifi.Interface); err != nil {
+				s.report(ifi.Name, err)
+				continue
+			}
+			for _, group := range s.groups {
+				err := d.send(s.conn, msg, group)
+				s.report(group.String()+" via "+ifi.Name, err)
+				if err == nil {
+					d.metrics.heartbeatsSent.WithLabelValues(ifi.Name).Inc()
+				}
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (d *Discovery) sendGoodbye() {
+	bye := d.self
+	bye.Type = msgGoodbye
+	bye.Seq = d.seq.Add(1)
+	msg, err := bye.MarshalBinary()
+	if err != nil {
+		log.Println("goodbye encode:", err)
+		return
+	}
+	d.broadcast(msg)
+}
+
+func (d *Discovery) decode(data []byte) (heartbeat, error) {
+	if d.auth != nil {
+		return d.auth.open(data, d.clock.Now())
+	}
+	var hb heartbeat
+	err := hb.UnmarshalBinary(data)
+	return hb, err
+}
+
+// send signs msg when authentication is enabled. Every datagram gets its
+// own nonce, so copies sent to different groups are not mistaken for
+// replays of each other.
+func (d *Discovery) send(conn PacketConn, msg []byte, dst net.Addr) error {
+	if d.auth != nil {
+		var err error
+		if msg, err = d.auth.seal(msg, d.clock.Now()); err != nil {
+			return err
+		}
+	}
+	_, err := conn.WritePacket(msg, dst)
+	return err
+}
+
+func (d *Discovery) isStopped() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.stopped
+}
@@ -0,0 +1,467 @@
+// Package discovery finds live peers on a LAN by exchanging multicast heartbeats.
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	DefaultInterval = 2 * time.Second
+	DefaultTimeout  = 5 * time.Second
+	DefaultRescan   = 10 * time.Second
+
+	rejectReportInterval = 10 * time.Second
+)
+
+type Config struct {
+	// Groups may mix IPv4 and IPv6 addresses; peers seen on several
+	// groups are merged by node id.
+	Groups []*net.UDPAddr
+	// Sources switches to source-specific multicast: groups are joined
+	// only for these senders (per address family) and heartbeats from
+	// anyone else are dropped.
+	Sources []net.IP
+	// Interfaces and ExcludeInterfaces hold interface names or glob
+	// patterns. With no Interfaces every interface that is up and
+	// multicast-capable is used.
+	Interfaces        []string
+	ExcludeInterfaces []string
+	// RescanInterval is how often interfaces are re-enumerated to pick up
+	// ones that appeared or went away.
+	RescanInterval time.Duration
+
+	Interval time.Duration
+	Timeout  time.Duration
+	// MulticastTTL is the IPv4 TTL / IPv6 hop limit of heartbeats; zero
+	// keeps the system default of 1, which never crosses a router.
+	MulticastTTL int
+	// DisableLoopback stops our heartbeats from being delivered to other
+	// nodes on the same host. Our own heartbeats are ignored either way.
+	DisableLoopback bool
+	// Detector selects how dead peers are recognised. With DetectorPhi a
+	// peer is reported suspect at PhiSuspect and dead at PhiThreshold.
+	// PhiPause is the silence beyond the usual interval that is taken in
+	// stride, one Interval by default, i.e. one lost heartbeat.
+	Detector     Detector
+	PhiThreshold float64
+	PhiSuspect   float64
+	PhiPause     time.Duration
+	// EchoInterval enables unicast echo probes to every peer to measure
+	// round-trip time; zero disables them.
+	EchoInterval time.Duration
+
+	NodeID   NodeID
+	Hostname string
+	Label    string
+	// Meta is advertised to peers with every heartbeat, e.g. the service
+	// name and port a node offers. It must fit into one datagram.
+	Meta map[string]string
+
+	// Election makes the node take part in electing a leader among the
+	// peers that have it enabled, see Leader.
+	Election bool
+
+	// Passive only listens: no heartbeats, no goodbye and no answers to
+	// solicitations, so that a one-off query never shows up as a peer.
+	// Solicit still works.
+	Passive bool
+
+	// Key enables HMAC-SHA256 authentication of every datagram; peers
+	// without the same key are ignored. MaxClockSkew bounds how old or
+	// early a signed datagram may be.
+	Key          []byte
+	MaxClockSkew time.Duration
+
+	// Registerer receives the discovery metrics; nil keeps them private.
+	Registerer prometheus.Registerer
+
+	// Clock and Transport replace the system clock and network stack,
+	// e.g. with a simulated network in tests. nil uses the real ones.
+	Clock     Clock
+	Transport Transport
+}
+
+type Stats struct {
+	Foreign   uint64
+	Malformed uint64
+	Overflow  uint64
+
+	Unauthenticated uint64
+	Replayed        uint64
+	Stale           uint64
+	UnlistedSource  uint64
+}
+
+func (s Stats) Rejected() uint64 {
+	return s.Unauthenticated + s.Replayed + s.Stale
+}
+
+type dropCounters struct {
+	foreign         atomic.Uint64
+	malformed       atomic.Uint64
+	overflow        atomic.Uint64
+	unauthenticated atomic.Uint64
+	replayed        atomic.Uint64
+	stale           atomic.Uint64
+	unlistedSource  atomic.Uint64
+
+	lastReport atomic.Int64
+}
+
+func (d *Discovery) countDrop(err error) {
+	var (
+		c      *atomic.Uint64
+		reason string
+	)
+	switch {
+	case errors.Is(err, errForeign):
+		c, reason = &d.drops.foreign, "foreign"
+	case errors.Is(err, errUnauthenticated):
+		c, reason = &d.drops.unauthenticated, "unauthenticated"
+	case errors.Is(err, errReplayed):
+		c, reason = &d.drops.replayed, "replayed"
+	case errors.Is(err, errStale):
+		c, reason = &d.drops.stale, "stale"
+	case errors.Is(err, errUnlistedSource):
+		c, reason = &d.drops.unlistedSource, "source"
+	default:
+		c, reason = &d.drops.malformed, "malformed"
+	}
+	c.Add(1)
+	d.metrics.dropped.WithLabelValues(reason).Inc()
+	if d.auth != nil && reason != "foreign" && reason != "malformed" && reason != "source" {
+		d.reportRejections()
+	}
+}
+
+// reportRejections logs the authentication rejection totals at most once
+// every rejectReportInterval.
+func (d *Discovery) reportRejections() {
+	now := d.clock.Now().UnixNano()
+	last := d.drops.lastReport.Load()
+	if now-last < int64(rejectReportInterval) || !d.drops.lastReport.CompareAndSwap(last, now) {
+		return
+	}
+	st := d.Stats()
+	log.Printf("discovery: rejected %d datagrams so far (%d unauthenticated, %d replayed, %d stale)",
+		st.Rejected(), st.Unauthenticated, st.Replayed, st.Stale)
+}
+
+type Discovery struct {
+	cfg       Config
+	self      heartbeat
+	clock     Clock
+	transport Transport
+
+	mu      sync.Mutex
+	peers   map[NodeID]*peer
+	subs    map[chan Event]struct{}
+	started bool
+	stopped bool
+
+	ifaces    map[int]ifaceInfo
+	listeners []*listener
+	senders   []*groupSender
+
+	echoSeq uint64
+	seq     atomic.Uint64
+	gone    map[NodeID]goneEntry
+	// timedOut keeps the arrival windows of peers the phi detector
+	// dropped.
+	timedOut map[NodeID]timedOutPeer
+	elect    *election
+
+	dupStarts map[time.Time]bool
+
+	senderDone chan struct{}
+
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	drops   dropCounters
+	metrics *metrics
+	auth    *authenticator
+}
+
+func New(cfg Config) (*Discovery, error) {
+	if len(cfg.Groups) == 0 {
+		return nil, errors.New("at least one multicast group is required")
+	}
+	for _, g := range cfg.Groups {
+		if g == nil || !g.IP.IsMulticast() {
+			return nil, fmt.Errorf("invalid multicast group %v", g)
+		}
+	}
+	for _, src := range cfg.Sources {
+		if src == nil || src.IsMulticast() || src.IsUnspecified() {
+			return nil, fmt.Errorf("invalid multicast source %v", src)
+		}
+	}
+	if cfg.NodeID.IsZero() {
+		return nil, errors.New("node id is required")
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	if cfg.MulticastTTL < 0 || cfg.MulticastTTL > 255 {
+		return nil, fmt.Errorf("multicast ttl %d out of range 0..255", cfg.MulticastTTL)
+	}
+	if cfg.Detector == "" {
+		cfg.Detector = DetectorTimeout
+	}
+	if _, err := ParseDetector(string(cfg.Detector)); err != nil {
+		return nil, err
+	}
+	if cfg.PhiThreshold <= 0 {
+		cfg.PhiThreshold = DefaultPhiThreshold
+	}
+	if cfg.PhiSuspect <= 0 {
+		cfg.PhiSuspect = min(DefaultPhiSuspect, cfg.PhiThreshold)
+	}
+	if cfg.PhiPause <= 0 {
+		cfg.PhiPause = cfg.Interval
+	}
+	if cfg.PhiSuspect > cfg.PhiThreshold {
+		return nil, fmt.Errorf("phi suspect level %.1f is above the threshold %.1f", cfg.PhiSuspect, cfg.PhiThreshold)
+	}
+	if cfg.RescanInterval <= 0 {
+		cfg.RescanInterval = DefaultRescan
+	}
+	if err := validatePatterns(cfg.Interfaces); err != nil {
+		return nil, err
+	}
+	if err := validatePatterns(cfg.ExcludeInterfaces); err != nil {
+		return nil, err
+	}
+
+	if cfg.MaxClockSkew <= 0 {
+		cfg.MaxClockSkew = DefaultMaxSkew
+	}
+	var auth *authenticator
+	if len(cfg.Key) > 0 {
+		if len(cfg.Key) < minKeyLen {
+			return nil, fmt.Errorf("key too short: %d bytes, want at least %d", len(cfg.Key), minKeyLen)
+		}
+		auth = newAuthenticator(cfg.Key, cfg.MaxClockSkew)
+	}
+
+	clock, transport := cfg.Clock, cfg.Transport
+	if clock == nil {
+		clock = systemClock{}
+	}
+	if transport == nil {
+		transport = systemTransport{}
+	}
+
+	m, err := newMetrics(cfg.Registerer)
+	if err != nil {
+		return nil, fmt.Errorf("register metrics: %w", err)
+	}
+
+	self := heartbeat{
+		Type:     msgHeartbeat,
+		NodeID:   cfg.NodeID,
+		Start:    clock.Now(),
+		Hostname: cfg.Hostname,
+		Label:    cfg.Label,
+		Meta:     maps.Clone(cfg.Meta),
+	}
+	if _, err := self.MarshalBinary(); err != nil {
+		return nil, fmt.Errorf("invalid heartbeat contents: %w", err)
+	}
+
+	var elect *election
+	if cfg.Election {
+		elect = &election{settleUntil: self.Start.Add(cfg.Timeout)}
+	}
+
+	return &Discovery{
+		cfg:        cfg,
+		clock:      clock,
+		transport:  transport,
+		metrics:    m,
+		auth:       auth,
+		self:       self,
+		peers:      make(map[NodeID]*peer),
+		gone:       make(map[NodeID]goneEntry),
+		timedOut:   make(map[NodeID]timedOutPeer),
+		elect:      elect,
+		subs:       make(map[chan Event]struct{}),
+		senderDone: make(chan struct{}),
+	}, nil
+}
+
+func (d *Discovery) ID() NodeID {
+	return d.cfg.NodeID
+}
+
+func (d *Discovery) Config() Config {
+	return d.cfg
+}
+
+func (d *Discovery) Stats() Stats {
+	return Stats{
+		Foreign:   d.drops.foreign.Load(),
+		Malformed: d.drops.malformed.Load(),
+		Overflow:  d.drops.overflow.Load(),
+
+		Unauthenticated: d.drops.unauthenticated.Load(),
+		Replayed:        d.drops.replayed.Load(),
+		Stale:           d.drops.stale.Load(),
+		UnlistedSource:  d.drops.unlistedSource.Load(),
+	}
+}
+
+func (d *Discovery) Start(ctx context.Context) error {
+	d.mu.Lock()
+	if d.started || d.stopped {
+		d.mu.Unlock()
+		return errors.New("discovery already started")
+	}
+	d.started = true
+	d.mu.Unlock()
+
+	var listeners []*listener
+	for _, group := range d.cfg.Groups {
+		l, err := listenGroup(d.transport, group, d.cfg.Sources)
+		if err != nil {
+			for _, l := range listeners {
+				l.conn.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, l)
+	}
+	senders, err := openSenders(d.transport, &d.cfg)
+	if err != nil {
+		for _, l := range listeners {
+			l.conn.Close()
+		}
+		return err
+	}
+
+	d.mu.Lock()
+	d.listeners = listeners
+	d.senders = senders
+	d.mu.Unlock()
+	d.rescan()
+
+	msgCh := make(chan packet, 100)
+	ctx, cancel := context.WithCancel(ctx)
+	d.mu.Lock()
+	d.cancel = cancel
+	d.mu.Unlock()
+
+	for _, l := range listeners {
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			d.reader(l, msgCh)
+		}()
+	}
+	for _, s := range senders {
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			d.unicastReader(s, msgCh)
+		}()
+	}
+	if d.cfg.Passive {
+		close(d.senderDone)
+	} else {
+		go func() {
+			defer close(d.senderDone)
+			d.sender(ctx)
+		}()
+	}
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		d.run(ctx, msgCh)
+	}()
+	return nil
+}
+
+// Stop announces our departure to every group on every interface, so that
+// peers drop us at once instead of waiting for their timeout, and then
+// closes the sockets and all subscriber channels. A passive node leaves
+// silently.
+func (d *Discovery) Stop() {
+	d.mu.Lock()
+	if d.stopped {
+		d.mu.Unlock()
+		return
+	}
+	d.stopped = true
+	cancel := d.cancel
+	d.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+		<-d.senderDone
+		if !d.cfg.Passive {
+			d.sendGoodbye()
+		}
+	}
+
+	d.mu.Lock()
+	for _, l := range d.listeners {
+		l.conn.Close()
+	}
+	for _, s := range d.senders {
+		s.conn.Close()
+	}
+	d.mu.Unlock()
+
+	d.wg.Wait()
+
+	d.mu.Lock()
+	for ch := range d.subs {
+		close(ch)
+	}
+	clear(d.subs)
+	d.mu.Unlock()
+}
+
+func (d *Discovery) run(ctx context.Context, msgCh <-chan packet) {
+	check := d.cfg.Timeout / 2
+	if d.cfg.Detector == DetectorPhi {
+		check = min(check, d.cfg.Interval/4)
+	}
+	cleanup := d.clock.NewTicker(check)
+	defer cleanup.Stop()
+	rescan := d.clock.NewTicker(d.cfg.RescanInterval)
+	defer rescan.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case pkt := <-msgCh:
+			switch pkt.hb.Type {
+			case msgEchoReply:
+				d.handleEchoReply(pkt.hb, d.clock.Now())
+			case msgGoodbye:
+				d.handleGoodbye(pkt.hb, d.clock.Now())
+			default:
+				d.handlePacket(pkt, d.clock.Now())
+			}
+		case now := <-cleanup.C():
+			d.expire(now)
+		case <-rescan.C():
+			d.rescan()
+		}
+	}
+}
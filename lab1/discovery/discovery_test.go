@@ -0,0 +1,476 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"testing/synctest"
+	"time"
+)
+
+const (
+	testInterval = 100 * time.Millisecond
+	testTimeout  = 500 * time.Millisecond
+)
+
+var testGroups = []struct {
+	name  string
+	group string
+}{
+	{"IPv4", "239.1.1.1:9999"},
+	{"IPv6", "[ff02::1234]:9999"},
+}
+
+func testConfig(t *testing.T, group string) Config {
+	t.Helper()
+	addr, err := net.ResolveUDPAddr("udp", group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Config{
+		Groups:   []*net.UDPAddr{addr},
+		Interval: testInterval,
+		Timeout:  testTimeout,
+		Detector: DetectorTimeout,
+	}
+}
+
+// startNodes creates and starts count nodes on net and stops them when the
+// test ends.
+func startNodes(t *testing.T, net *simNet, cfg Config, count int) []*simNode {
+	t.Helper()
+	nodes := make([]*simNode, count)
+	for i := range nodes {
+		nodes[i] = net.addNode(t, cfg)
+	}
+	for _, n := range nodes {
+		n.start(t)
+	}
+	t.Cleanup(func() {
+		for _, n := range nodes {
+			n.stop()
+		}
+	})
+	return nodes
+}
+
+func requireMesh(t *testing.T, nodes []*simNode) {
+	t.Helper()
+	for _, a := range nodes {
+		for _, b := range nodes {
+			if a != b && !a.hasPeer(b) {
+				t.Errorf("%s does not see %s", a.d.cfg.Hostname, b.d.cfg.Hostname)
+			}
+		}
+	}
+}
+
+func TestSimJoin(t *testing.T) {
+	for _, tc := range testGroups {
+		t.Run(tc.name, func(t *testing.T) {
+			synctest.Test(t, func(t *testing.T) {
+				sim := newSimNet(1)
+				nodes := startNodes(t, sim, testConfig(t, tc.group), 4)
+
+				sim.clock.Advance(2 * testInterval)
+				requireMesh(t, nodes)
+				for _, a := range nodes {
+					for _, b := range nodes {
+						if a == b {
+							continue
+						}
+						if got := len(a.eventsFor(PeerJoined, b)); got != 1 {
+							t.Errorf("%s got %d join events for %s, want 1", a.d.cfg.Hostname, got, b.d.cfg.Hostname)
+						}
+					}
+				}
+				if p := nodes[0].d.Peers()[0]; p.Interfaces[0] != "sim0" {
+					t.Errorf("peer interfaces = %v, want [sim0]", p.Interfaces)
+				}
+			})
+		})
+	}
+}
+
+func TestSimGracefulLeave(t *testing.T) {
+	for _, tc := range testGroups {
+		t.Run(tc.name, func(t *testing.T) {
+			synctest.Test(t, func(t *testing.T) {
+				sim := newSimNet(1)
+				nodes := startNodes(t, sim, testConfig(t, tc.group), 3)
+				sim.clock.Advance(2 * testInterval)
+
+				nodes[2].stop()
+				sim.clock.Advance(testInterval / 10)
+				for _, n := range nodes[:2] {
+					left := n.eventsFor(PeerLeft, nodes[2])
+					if len(left) != 1 || left[0].Reason != LeaveGoodbye {
+						t.Fatalf("%s: leave events %+v, want one goodbye", n.d.cfg.Hostname, left)
+					}
+					if n.hasPeer(nodes[2]) {
+						t.Errorf("%s still lists the node that left", n.d.cfg.Hostname)
+					}
+				}
+			})
+		})
+	}
+}
+
+// TestSimPassiveQuery checks that a passive node learns the peers from
+// their answers to its solicitation while never showing up as a peer
+// itself, not even to another query.
+func TestSimPassiveQuery(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		sim := newSimNet(1)
+		cfg := testConfig(t, testGroups[0].group)
+		nodes := startNodes(t, sim, cfg, 2)
+		sim.clock.Advance(2 * testInterval)
+
+		cfg.Passive = true
+		queries := []*simNode{sim.addNode(t, cfg), sim.addNode(t, cfg)}
+		for _, q := range queries {
+			q.start(t)
+			q.d.Solicit()
+		}
+		// Well before the next regular heartbeat.
+		sim.clock.Advance(testInterval / 10)
+		for _, q := range queries {
+			for _, n := range nodes {
+				if !q.hasPeer(n) {
+					t.Errorf("%s did not hear from %s", q.d.cfg.Hostname, n.d.cfg.Hostname)
+				}
+			}
+		}
+		if queries[1].hasPeer(queries[0]) {
+			t.Error("a passive node answered a solicitation")
+		}
+
+		sim.clock.Advance(3 * testInterval)
+		for _, q := range queries {
+			q.stop()
+		}
+		sim.clock.Advance(testInterval)
+		for _, n := range nodes {
+			for _, q := range queries {
+				if evs := n.eventsFor(PeerJoined, q); len(evs) != 0 {
+					t.Errorf("%s saw the passive %s join", n.d.cfg.Hostname, q.d.cfg.Hostname)
+				}
+			}
+		}
+	})
+}
+
+func TestSimTimeout(t *testing.T) {
+	for _, tc := range testGroups {
+		t.Run(tc.name, func(t *testing.T) {
+			synctest.Test(t, func(t *testing.T) {
+				sim := newSimNet(1)
+				nodes := startNodes(t, sim, testConfig(t, tc.group), 3)
+				sim.clock.Advance(2 * testInterval)
+
+				crashed := sim.clock.Now()
+				nodes[2].crash()
+				sim.clock.Advance(testTimeout - testInterval)
+				if left := nodes[0].eventsFor(PeerLeft, nodes[2]); len(left) != 0 {
+					t.Fatalf("peer dropped %s after the crash, before the timeout", left[0].Time.Sub(crashed))
+				}
+
+				sim.clock.Advance(testTimeout)
+				for _, n := range nodes[:2] {
+					left := n.eventsFor(PeerLeft, nodes[2])
+					if len(left) != 1 || left[0].Reason != LeaveTimeout {
+						t.Fatalf("%s: leave events %+v, want one timeout", n.d.cfg.Hostname, left)
+					}
+					// Expiry runs every Timeout/2 and the last heartbeat may
+					// predate the crash by up to one interval.
+					if after := left[0].Time.Sub(crashed); after < testTimeout-testInterval || after > testTimeout*3/2 {
+						t.Errorf("%s: timed out %s after the crash", n.d.cfg.Hostname, after)
+					}
+				}
+				requireMesh(t, nodes[:2])
+			})
+		})
+	}
+}
+
+func TestSimLossAndDelay(t *testing.T) {
+	for _, tc := range testGroups {
+		t.Run(tc.name, func(t *testing.T) {
+			synctest.Test(t, func(t *testing.T) {
+				sim := newSimNet(7)
+				sim.setLoss(0.2)
+				sim.setDelay(20*time.Millisecond, 10*time.Millisecond)
+				cfg := testConfig(t, tc.group)
+				cfg.EchoInterval = testInterval
+				nodes := startNodes(t, sim, cfg, 3)
+
+				sim.clock.Advance(20 * time.Second)
+				requireMesh(t, nodes)
+				for _, a := range nodes {
+					for _, b := range nodes {
+						if a == b {
+							continue
+						}
+						if left := a.eventsFor(PeerLeft, b); len(left) != 0 {
+							t.Errorf("%s dropped %s under 20%% loss", a.d.cfg.Hostname, b.d.cfg.Hostname)
+						}
+					}
+				}
+				for _, p := range nodes[0].d.Peers() {
+					if p.Loss < 0.1 || p.Loss > 0.3 {
+						t.Errorf("peer %s loss %.2f, want about 0.2", p.Hostname, p.Loss)
+					}
+					if p.RTT < 40*time.Millisecond || p.RTT > 60*time.Millisecond {
+						t.Errorf("peer %s rtt %s, want 40-60ms", p.Hostname, p.RTT)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestSimPhiLoss(t *testing.T) {
+	for _, tc := range testGroups {
+		t.Run(tc.name, func(t *testing.T) {
+			synctest.Test(t, func(t *testing.T) {
+				sim := newSimNet(3)
+				sim.setLoss(0.05)
+				cfg := testConfig(t, tc.group)
+				cfg.Detector = DetectorPhi
+				nodes := startNodes(t, sim, cfg, 3)
+
+				sim.clock.Advance(20 * time.Second)
+				requireMesh(t, nodes)
+				for _, a := range nodes {
+					for _, b := range nodes {
+						if a == b {
+							continue
+						}
+						if left := a.eventsFor(PeerLeft, b); len(left) != 0 {
+							t.Errorf("%s dropped %s under 5%% loss", a.d.cfg.Hostname, b.d.cfg.Hostname)
+						}
+					}
+				}
+
+				// A real failure is still noticed within a few intervals.
+				sim.setLoss(0)
+				crashed := sim.clock.Now()
+				nodes[2].crash()
+				sim.clock.Advance(2 * testTimeout)
+				left := nodes[0].eventsFor(PeerLeft, nodes[2])
+				if len(left) != 1 || left[0].Reason != LeaveTimeout {
+					t.Fatalf("leave events %+v, want one timeout", left)
+				}
+				if after := left[0].Time.Sub(crashed); after > 10*testInterval {
+					t.Errorf("declared dead %s after the crash", after)
+				}
+			})
+		})
+	}
+}
+
+// TestSimPhiRejoin checks that a peer wrongly declared dead keeps what the
+// detector learned about it when it is heard again.
+func TestSimPhiRejoin(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		sim := newSimNet(1)
+		cfg := testConfig(t, testGroups[0].group)
+		cfg.Detector = DetectorPhi
+		nodes := startNodes(t, sim, cfg, 2)
+		sim.clock.Advance(20 * testInterval)
+
+		sim.partition([]*simHost{nodes[0].host}, []*simHost{nodes[1].host})
+		sim.clock.Advance(testTimeout * 2)
+		sim.heal()
+		sim.clock.Advance(testInterval)
+		if n := len(nodes[0].eventsFor(PeerLeft, nodes[1])); n != 1 {
+			t.Fatalf("%d leave events during the partition, want 1", n)
+		}
+		if !nodes[0].hasPeer(nodes[1]) {
+			t.Fatal("peer did not rejoin")
+		}
+		d := nodes[0].d
+		d.mu.Lock()
+		n := d.peers[nodes[1].d.ID()].arrivals.n
+		d.mu.Unlock()
+		if n < 19 {
+			t.Errorf("rejoined peer has %d intervals, want those from before the partition", n)
+		}
+	})
+}
+
+func TestSimPartition(t *testing.T) {
+	for _, tc := range testGroups {
+		t.Run(tc.name, func(t *testing.T) {
+			synctest.Test(t, func(t *testing.T) {
+				sim := newSimNet(1)
+				nodes := startNodes(t, sim, testConfig(t, tc.group), 4)
+				sim.clock.Advance(2 * testInterval)
+
+				left, right := nodes[:2], nodes[2:]
+				sim.partition([]*simHost{left[0].host, left[1].host}, []*simHost{right[0].host, right[1].host})
+				sim.clock.Advance(2 * testTimeout)
+				requireMesh(t, left)
+				requireMesh(t, right)
+				for _, a := range left {
+					for _, b := range right {
+						if a.hasPeer(b) || b.hasPeer(a) {
+							t.Errorf("%s and %s still see each other across the partition", a.d.cfg.Hostname, b.d.cfg.Hostname)
+						}
+						if n := len(a.eventsFor(PeerLeft, b)); n != 1 {
+							t.Errorf("%s got %d leave events for %s, want 1", a.d.cfg.Hostname, n, b.d.cfg.Hostname)
+						}
+					}
+				}
+
+				sim.heal()
+				sim.clock.Advance(2 * testInterval)
+				requireMesh(t, nodes)
+				for _, a := range left {
+					for _, b := range right {
+						if n := len(a.eventsFor(PeerJoined, b)); n != 2 {
+							t.Errorf("%s got %d join events for %s, want 2", a.d.cfg.Hostname, n, b.d.cfg.Hostname)
+						}
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestSimSourceSpecific(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		sim := newSimNet(1)
+		cfg := testConfig(t, "232.1.1.1:9999")
+		// Hosts are numbered from 10.0.0.1; only the first may be heard.
+		cfg.Sources = []net.IP{net.IPv4(10, 0, 0, 1)}
+		nodes := startNodes(t, sim, cfg, 3)
+		sim.clock.Advance(2 * testInterval)
+
+		if !nodes[1].hasPeer(nodes[0]) || nodes[1].hasPeer(nodes[2]) {
+			t.Errorf("node2 peers %v, want only node1", nodes[1].d.Peers())
+		}
+		if p := nodes[1].d.Peers(); len(p) == 1 && (len(p[0].Channels) != 1 || p[0].Channels[0] != "(10.0.0.1, 232.1.1.1:9999)") {
+			t.Errorf("channels = %v", p[0].Channels)
+		}
+
+		// An unlisted host sending straight to the sender socket, as in an
+		// answer to a solicitation, is not heard either.
+		dropped := nodes[1].d.Stats().UnlistedSource
+		nodes[2].d.answerSolicit(nodes[1].d.senders[0].conn.(*simConn).local)
+		sim.clock.Advance(testInterval / 10)
+		if nodes[1].hasPeer(nodes[2]) {
+			t.Error("unlisted host became a peer over unicast")
+		}
+		if n := nodes[1].d.Stats().UnlistedSource; n <= dropped {
+			t.Errorf("unlisted source count stayed at %d", n)
+		}
+	})
+}
+
+func requireLeader(t *testing.T, nodes []*simNode, leader *simNode, term uint64) {
+	t.Helper()
+	for _, n := range nodes {
+		l := n.d.Leader()
+		if l.Leader != leader.d.ID() || l.Term != term || l.Self != (n == leader) {
+			t.Errorf("%s follows %+v, want %s in term %d", n.d.cfg.Hostname, l, leader.d.cfg.Hostname, term)
+		}
+	}
+}
+
+func TestSimElection(t *testing.T) {
+	for _, tc := range testGroups {
+		t.Run(tc.name, func(t *testing.T) {
+			synctest.Test(t, func(t *testing.T) {
+				sim := newSimNet(1)
+				cfg := testConfig(t, tc.group)
+				cfg.Election = true
+				nodes := startNodes(t, sim, cfg, 4)
+
+				// Node ids follow the start order, so node1 has the lowest.
+				sim.clock.Advance(testTimeout + 2*testInterval)
+				requireLeader(t, nodes, nodes[0], 1)
+
+				nodes[0].crash()
+				sim.clock.Advance(2 * testTimeout)
+				requireLeader(t, nodes[1:], nodes[1], 2)
+
+				// A partition elects a second leader on the minority side;
+				// after healing the higher term wins everywhere.
+				sim.partition([]*simHost{nodes[1].host}, []*simHost{nodes[2].host, nodes[3].host})
+				sim.clock.Advance(2 * testTimeout)
+				requireLeader(t, nodes[1:2], nodes[1], 2)
+				requireLeader(t, nodes[2:], nodes[2], 3)
+
+				sim.heal()
+				sim.clock.Advance(2 * testInterval)
+				requireLeader(t, nodes[1:], nodes[2], 3)
+			})
+		})
+	}
+}
+
+// TestLoopbackJoinLeave runs two nodes in-process on the real network
+// stack, relying on multicast loopback to deliver between them.
+func TestLoopbackJoinLeave(t *testing.T) {
+	if testing.Short() {
+		t.Skip("uses the real network")
+	}
+	// A free port keeps concurrent test runs apart.
+	probe, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := probe.LocalAddr().(*net.UDPAddr).Port
+	probe.Close()
+	cfg := Config{
+		Groups:   []*net.UDPAddr{{IP: net.IPv4(239, 1, 1, 2), Port: port}},
+		Interval: testInterval,
+		Timeout:  testTimeout,
+	}
+
+	nodes := make([]*Discovery, 2)
+	for i := range nodes {
+		c := cfg
+		var err error
+		if c.NodeID, err = NewNodeID(); err != nil {
+			t.Fatal(err)
+		}
+		c.Hostname = fmt.Sprintf("node%d", i)
+		if nodes[i], err = New(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	events, unsubscribe := nodes[0].Subscribe()
+	defer unsubscribe()
+	for _, d := range nodes {
+		if err := d.Start(context.Background()); err != nil {
+			t.Skipf("no multicast: %v", err)
+		}
+		defer d.Stop()
+		if len(d.Interfaces()) == 0 {
+			t.Skip("no multicast-capable interface")
+		}
+	}
+
+	await := func(typ EventType) Event {
+		t.Helper()
+		deadline := time.After(20 * testInterval)
+		for {
+			select {
+			case ev := <-events:
+				if ev.Type == typ && ev.Peer.ID == nodes[1].ID() {
+					return ev
+				}
+			case <-deadline:
+				t.Fatalf("no %v event for the other node", typ)
+			}
+		}
+	}
+	await(PeerJoined)
+	nodes[1].Stop()
+	if ev := await(PeerLeft); ev.Reason != LeaveGoodbye {
+		t.Errorf("left with reason %q, want a goodbye", ev.Reason)
+	}
+}
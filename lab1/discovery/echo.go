@@ -0,0 +1,109 @@
+package discovery
+
+import (
+	"log"
+	"net"
+	"time"
+)
+
+// unicastReader serves the per-family sender socket, which is where peers
+// address echo requests and where replies to our own echo requests and
+// solicitations arrive. With sources configured it drops datagrams from
+// anyone the multicast listeners would not hear either.
+func (d *Discovery) unicastReader(s *groupSender, ch chan<- packet) {
+	d.readLoop(s.conn, func(hb heartbeat, src *net.UDPAddr, ifIndex int) {
+		if !d.listedSource(s.v6, src.IP) {
+			d.countDrop(errUnlistedSource)
+			return
+		}
+		switch hb.Type {
+		case msgEchoRequest:
+			reply := hb
+			reply.Type = msgEchoReply
+			reply.NodeID = d.self.NodeID
+			reply.Start = d.self.Start
+			reply.Hostname = ""
+			reply.Label = ""
+			reply.AuthTime = time.Time{}
+			reply.Nonce = nil
+			msg, err := reply.MarshalBinary()
+			if err != nil {
+				log.Println("echo reply encode:", err)
+				return
+			}
+			if err := d.send(s.conn, msg, src); err != nil {
+				log.Printf("echo reply to %s: %v", src, err)
+			}
+		case msgEchoReply, msgHeartbeat:
+			d.enqueue(ch, packet{hb: hb, src: src, ifIndex: ifIndex})
+		}
+	})
+}
+
+// listedSource reports whether a listener of the family accepts datagrams
+// from ip. The listeners are fixed once Start returns.
+func (d *Discovery) listedSource(v6 bool, ip net.IP) bool {
+	for _, l := range d.listeners {
+		if isV6(l.group) != v6 {
+			continue
+		}
+		if _, ok := l.channel(ip); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Discovery) sendEchoRequests() {
+	d.mu.Lock()
+	targets := make([]*net.UDPAddr, 0, len(d.peers))
+	for _, p := range d.peers {
+		if p.lastSrc != nil {
+			targets = append(targets, p.lastSrc)
+		}
+	}
+	d.mu.Unlock()
+
+	d.echoSeq++
+	req := heartbeat{
+		Type:   msgEchoRequest,
+		NodeID: d.self.NodeID,
+		Start:  d.self.Start,
+		Seq:    d.echoSeq,
+		SentAt: d.clock.Now(),
+	}
+	msg, err := req.MarshalBinary()
+	if err != nil {
+		log.Println("echo request encode:", err)
+		return
+	}
+	for _, dst := range targets {
+		for _, s := range d.senders {
+			if s.v6 != isV6(dst) {
+				continue
+			}
+			if err := d.send(s.conn, msg, dst); err != nil {
+				log.Printf("echo request to %s: %v", dst, err)
+			}
+		}
+	}
+}
+
+func (d *Discovery) handleEchoReply(hb heartbeat, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	p, ok := d.peers[hb.NodeID]
+	if !ok || hb.SentAt.IsZero() {
+		return
+	}
+	sample := now.Sub(hb.SentAt)
+	if sample < 0 {
+		return
+	}
+	if p.rtt == 0 {
+		p.rtt = sample
+	} else {
+		p.rtt += (sample - p.rtt) / 8
+	}
+}
@@ -0,0 +1,128 @@
+package discovery
+
+import (
+	"bytes"
+	"time"
+)
+
+// Leadership is a node's view of who leads the group. Term grows with
+// every election; Leader is zero while no leader is known.
+type Leadership struct {
+	Leader NodeID `json:"leader"`
+	Term   uint64 `json:"term"`
+	// Self is set when this node is the leader.
+	Self bool `json:"self"`
+}
+
+// ballot is the (term, leader) pair every participating node puts into its
+// heartbeats.
+type ballot struct {
+	Term   uint64
+	Leader NodeID
+}
+
+// beats reports whether b should replace a: the higher term wins, and of
+// two claims in one term the lower leader id, so that the sides of a healed
+// partition settle on one leader.
+func (b ballot) beats(a ballot) bool {
+	if b.Term != a.Term {
+		return b.Term > a.Term
+	}
+	if b.Leader.IsZero() {
+		return false
+	}
+	return a.Leader.IsZero() || bytes.Compare(b.Leader[:], a.Leader[:]) < 0
+}
+
+// election implements lowest-id-with-lease: when the leader is lost, the
+// participating node with the lowest id claims the next term. Followers
+// hold the leader's lease for one Timeout and renew it with every heartbeat
+// in which the leader claims itself, so a live leader is never displaced
+// by a lower id that joins later.
+type election struct {
+	cur        ballot
+	leaseUntil time.Time
+	// No claim is made before settleUntil, one Timeout after start, so
+	// that a starting node first hears an existing leader.
+	settleUntil time.Time
+}
+
+func (d *Discovery) Leader() Leadership {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.leadership()
+}
+
+// leadership must be called with d.mu held.
+func (d *Discovery) leadership() Leadership {
+	if d.elect == nil {
+		return Leadership{}
+	}
+	cur := d.elect.cur
+	return Leadership{Leader: cur.Leader, Term: cur.Term, Self: cur.Leader == d.self.NodeID}
+}
+
+// ballot returns what our next heartbeat advertises, nil when the node
+// does not take part in elections.
+func (d *Discovery) ballot() *ballot {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.elect == nil {
+		return nil
+	}
+	b := d.elect.cur
+	return &b
+}
+
+// observeBallot must be called with d.mu held.
+func (d *Discovery) observeBallot(from NodeID, b ballot, now time.Time) {
+	e := d.elect
+	if e == nil {
+		return
+	}
+	switch {
+	case b.beats(e.cur):
+		d.setLeader(b, now)
+		e.leaseUntil = now.Add(d.cfg.Timeout)
+	case b == e.cur && b.Leader == from:
+		e.leaseUntil = now.Add(d.cfg.Timeout)
+	}
+}
+
+// checkLeader starts an election once the leader is gone. It must be
+// called with d.mu held.
+func (d *Discovery) checkLeader(now time.Time) {
+	e := d.elect
+	if e == nil || e.cur.Leader == d.self.NodeID {
+		return
+	}
+	if !e.cur.Leader.IsZero() {
+		if _, alive := d.peers[e.cur.Leader]; alive && !now.After(e.leaseUntil) {
+			return
+		}
+		d.setLeader(ballot{Term: e.cur.Term}, now)
+	}
+	if now.Before(e.settleUntil) {
+		return
+	}
+	for id, p := range d.peers {
+		if p.info.Election != nil && bytes.Compare(id[:], d.self.NodeID[:]) < 0 {
+			// A lower id is around; it is up to that node to claim.
+			return
+		}
+	}
+	d.setLeader(ballot{Term: e.cur.Term + 1, Leader: d.self.NodeID}, now)
+}
+
+// setLeader must be called with d.mu held.
+func (d *Discovery) setLeader(b ballot, now time.Time) {
+	d.elect.cur = b
+	d.metrics.setLeadership(b.Term, b.Leader == d.self.NodeID)
+	ev := Event{Type: LeaderChanged, Time: now}
+	l := d.leadership()
+	ev.Leadership = &l
+	if p, ok := d.peers[b.Leader]; ok {
+		ev.Peer = p.snapshot()
+	}
+	d.publish(ev)
+}
@@ -0,0 +1,210 @@
+package discovery
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	heartbeatMagic   = "L1HB"
+	heartbeatVersion = 1
+	headerLen        = 4 + 1 + 1 + 16 + 8 + 8
+	maxDatagram      = 1500
+)
+
+type msgType uint8
+
+const (
+	msgHeartbeat msgType = iota + 1
+	// Echo messages are exchanged over unicast to measure round-trip time;
+	// the reply carries the requester's SentAt back unchanged.
+	msgEchoRequest
+	msgEchoReply
+	// msgGoodbye is multicast once on shutdown so that peers can drop the
+	// node immediately.
+	msgGoodbye
+	// msgSolicit asks every node to answer with a unicast heartbeat.
+	msgSolicit
+)
+
+const (
+	tagHostname uint8 = 1
+	tagLabel    uint8 = 2
+	tagSentAt   uint8 = 3
+	tagAuthTime uint8 = 4
+	tagNonce    uint8 = 5
+	tagMAC      uint8 = 6
+	// tagMeta repeats once per metadata entry: key length (1 byte), key,
+	// value.
+	tagMeta uint8 = 7
+	// tagElection carries the sender's election term (8 bytes) and the
+	// leader it follows (16 bytes); only nodes taking part send it.
+	tagElection uint8 = 8
+)
+
+const electionLen = 8 + 16
+
+var (
+	errForeign   = errors.New("not a heartbeat datagram")
+	errMalformed = errors.New("malformed heartbeat")
+
+	errUnlistedSource = errors.New("sender is not a configured multicast source")
+)
+
+type heartbeat struct {
+	Type     msgType
+	NodeID   NodeID
+	Start    time.Time
+	Seq      uint64
+	Hostname string
+	Label    string
+	SentAt   time.Time
+	Meta     map[string]string
+	Election *ballot
+
+	// Filled in from the authentication trailer, see authenticator.
+	AuthTime time.Time
+	Nonce    []byte
+}
+
+func (h *heartbeat) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, headerLen, maxDatagram)
+	copy(buf, heartbeatMagic)
+	buf[4] = heartbeatVersion
+	buf[5] = byte(h.Type)
+	copy(buf[6:22], h.NodeID[:])
+	binary.BigEndian.PutUint64(buf[22:30], uint64(h.Start.UnixNano()))
+	binary.BigEndian.PutUint64(buf[30:38], h.Seq)
+
+	var err error
+	if buf, err = appendTLV(buf, tagHostname, h.Hostname); err != nil {
+		return nil, err
+	}
+	if h.Label != "" {
+		if buf, err = appendTLV(buf, tagLabel, h.Label); err != nil {
+			return nil, err
+		}
+	}
+	if !h.SentAt.IsZero() {
+		buf = appendTimeTLV(buf, tagSentAt, h.SentAt)
+	}
+	if h.Election != nil {
+		val := binary.BigEndian.AppendUint64(nil, h.Election.Term)
+		val = append(val, h.Election.Leader[:]...)
+		if buf, err = appendTLV(buf, tagElection, string(val)); err != nil {
+			return nil, err
+		}
+	}
+	keys := make([]string, 0, len(h.Meta))
+	for k := range h.Meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if len(k) == 0 || len(k) > 0xFF {
+			return nil, fmt.Errorf("bad metadata key %q", k)
+		}
+		entry := string([]byte{byte(len(k))}) + k + h.Meta[k]
+		if buf, err = appendTLV(buf, tagMeta, entry); err != nil {
+			return nil, err
+		}
+	}
+	if len(buf) > maxDatagram-authOverhead {
+		return nil, fmt.Errorf("heartbeat too large: %d bytes", len(buf))
+	}
+	return buf, nil
+}
+
+func (h *heartbeat) UnmarshalBinary(data []byte) error {
+	if len(data) < 4 || string(data[:4]) != heartbeatMagic {
+		return errForeign
+	}
+	if len(data) < headerLen {
+		return fmt.Errorf("%w: short header (%d bytes)", errMalformed, len(data))
+	}
+	if data[4] != heartbeatVersion {
+		return fmt.Errorf("%w: unsupported version %d", errMalformed, data[4])
+	}
+
+	*h = heartbeat{
+		Type:  msgType(data[5]),
+		Start: time.Unix(0, int64(binary.BigEndian.Uint64(data[22:30]))),
+		Seq:   binary.BigEndian.Uint64(data[30:38]),
+	}
+	copy(h.NodeID[:], data[6:22])
+	if h.Type < msgHeartbeat || h.Type > msgSolicit {
+		return fmt.Errorf("%w: unknown message type %d", errMalformed, h.Type)
+	}
+	if h.NodeID.IsZero() {
+		return fmt.Errorf("%w: empty node id", errMalformed)
+	}
+
+	rest := data[headerLen:]
+	for len(rest) > 0 {
+		if len(rest) < 3 {
+			return fmt.Errorf("%w: truncated field header", errMalformed)
+		}
+		tag := rest[0]
+		n := int(binary.BigEndian.Uint16(rest[1:3]))
+		if len(rest) < 3+n {
+			return fmt.Errorf("%w: truncated field %d", errMalformed, tag)
+		}
+		val := rest[3 : 3+n]
+		rest = rest[3+n:]
+
+		switch tag {
+		case tagHostname:
+			h.Hostname = string(val)
+		case tagLabel:
+			h.Label = string(val)
+		case tagSentAt, tagAuthTime:
+			if len(val) != 8 {
+				return fmt.Errorf("%w: bad timestamp length %d", errMalformed, len(val))
+			}
+			t := time.Unix(0, int64(binary.BigEndian.Uint64(val)))
+			if tag == tagSentAt {
+				h.SentAt = t
+			} else {
+				h.AuthTime = t
+			}
+		case tagNonce:
+			h.Nonce = bytes.Clone(val)
+		case tagMeta:
+			if len(val) < 1 || len(val) < 1+int(val[0]) || val[0] == 0 {
+				return fmt.Errorf("%w: bad metadata entry", errMalformed)
+			}
+			if h.Meta == nil {
+				h.Meta = make(map[string]string)
+			}
+			k := 1 + int(val[0])
+			h.Meta[string(val[1:k])] = string(val[k:])
+		case tagElection:
+			if len(val) != electionLen {
+				return fmt.Errorf("%w: bad election field length %d", errMalformed, len(val))
+			}
+			b := &ballot{Term: binary.BigEndian.Uint64(val[:8])}
+			copy(b.Leader[:], val[8:])
+			h.Election = b
+		}
+	}
+	return nil
+}
+
+func appendTLV(buf []byte, tag uint8, val string) ([]byte, error) {
+	if len(val) > 0xFFFF {
+		return nil, fmt.Errorf("field %d too long: %d bytes", tag, len(val))
+	}
+	buf = append(buf, tag)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(val)))
+	return append(buf, val...), nil
+}
+
+func appendTimeTLV(buf []byte, tag uint8, t time.Time) []byte {
+	buf = append(buf, tag)
+	buf = binary.BigEndian.AppendUint16(buf, 8)
+	return binary.BigEndian.AppendUint64(buf, uint64(t.UnixNano()))
+}
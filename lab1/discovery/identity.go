@@ -0,0 +1,132 @@
+package discovery
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type NodeID [16]byte
+
+func NewNodeID() (NodeID, error) {
+	var id NodeID
+	if _, err := rand.Read(id[:]); err != nil {
+		return id, err
+	}
+	id[6] = (id[6] & 0x0f) | 0x40
+	id[8] = (id[8] & 0x3f) | 0x80
+	return id, nil
+}
+
+func ParseNodeID(s string) (NodeID, error) {
+	var id NodeID
+	raw, err := hex.DecodeString(strings.ReplaceAll(strings.TrimSpace(s), "-", ""))
+	if err != nil {
+		return id, fmt.Errorf("invalid node id %q: %w", s, err)
+	}
+	if len(raw) != len(id) {
+		return id, fmt.Errorf("invalid node id %q: want %d bytes, got %d", s, len(id), len(raw))
+	}
+	copy(id[:], raw)
+	return id, nil
+}
+
+func (id NodeID) String() string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:16])
+}
+
+func (id NodeID) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+func (id *NodeID) UnmarshalText(b []byte) error {
+	parsed, err := ParseNodeID(string(b))
+	if err != nil {
+		return err
+	}
+	*id = parsed
+	return nil
+}
+
+func (id NodeID) IsZero() bool {
+	return id == NodeID{}
+}
+
+func DefaultIDFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ".lab1-node-id"
+	}
+	return filepath.Join(dir, "lab1", "node-id")
+}
+
+// maxIDSlots bounds how many nodes on one host can run with the default id
+// file.
+const maxIDSlots = 64
+
+var errIDFileInUse = errors.New("node id file is in use by another running node")
+
+// heldIDFiles keeps the claimed id files open, and so locked, until exit.
+var heldIDFiles []*os.File
+
+// ClaimNodeID loads the node id from path, creating it if missing, and locks
+// the file for as long as the process runs so that two nodes on one host
+// never share an id. When another node holds path, ClaimNodeID fails unless
+// spill is set, in which case it claims the first free of path.2, path.3,
+// ... instead. It returns the id and the file it came from.
+func ClaimNodeID(path string, spill bool) (NodeID, string, error) {
+	for slot := 1; slot <= maxIDSlots; slot++ {
+		p := path
+		if slot > 1 {
+			p = fmt.Sprintf("%s.%d", path, slot)
+		}
+		id, err := claimIDFile(p)
+		if err == nil {
+			return id, p, nil
+		}
+		if !errors.Is(err, errIDFileInUse) || !spill {
+			return NodeID{}, p, err
+		}
+	}
+	return NodeID{}, path, fmt.Errorf("all %d node id files next to %s are in use", maxIDSlots, path)
+}
+
+func claimIDFile(path string) (NodeID, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return NodeID{}, fmt.Errorf("create node id dir: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return NodeID{}, err
+	}
+	// The lock comes first, so that of two nodes starting at once only one
+	// creates the id.
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return NodeID{}, err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		f.Close()
+		return NodeID{}, err
+	}
+	var id NodeID
+	if len(strings.TrimSpace(string(data))) > 0 {
+		id, err = ParseNodeID(string(data))
+	} else if id, err = NewNodeID(); err != nil {
+		err = fmt.Errorf("generate node id: %w", err)
+	} else if _, err = f.WriteString(id.String() + "\n"); err != nil {
+		err = fmt.Errorf("save node id: %w", err)
+	}
+	if err != nil {
+		f.Close()
+		return NodeID{}, err
+	}
+	heldIDFiles = append(heldIDFiles, f)
+	return id, nil
+}
@@ -0,0 +1,43 @@
+package discovery
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestClaimNodeID(t *testing.T) {
+	if !idLocking {
+		t.Skip("id files are not locked on this platform")
+	}
+	path := filepath.Join(t.TempDir(), "lab1", "node-id")
+	release := func() {
+		for _, f := range heldIDFiles {
+			f.Close()
+		}
+		heldIDFiles = nil
+	}
+	t.Cleanup(release)
+
+	first, p, err := ClaimNodeID(path, false)
+	if err != nil || p != path {
+		t.Fatalf("ClaimNodeID = %s, %q, %v", first, p, err)
+	}
+	if _, _, err := ClaimNodeID(path, false); !errors.Is(err, errIDFileInUse) {
+		t.Fatalf("second claim of an explicit file = %v, want %v", err, errIDFileInUse)
+	}
+	second, p, err := ClaimNodeID(path, true)
+	if err != nil || p != path+".2" {
+		t.Fatalf("spilled claim = %s, %q, %v", second, p, err)
+	}
+	if second == first {
+		t.Error("two running nodes got the same id")
+	}
+
+	// The id survives a restart of its node.
+	release()
+	again, p, err := ClaimNodeID(path, true)
+	if err != nil || p != path || again != first {
+		t.Errorf("after restart claimed %s from %q, %v; want %s from %q", again, p, err, first, path)
+	}
+}
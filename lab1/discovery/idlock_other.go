@@ -0,0 +1,11 @@
+//go:build !unix
+
+package discovery
+
+import "os"
+
+// Without flock two nodes on one host can still end up sharing an id file;
+// reportDuplicateID is then the only hint.
+const idLocking = false
+
+func lockFile(f *os.File) error { return nil }
@@ -0,0 +1,19 @@
+//go:build unix
+
+package discovery
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+const idLocking = true
+
+func lockFile(f *os.File) error {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return errIDFileInUse
+	}
+	return err
+}
@@ -0,0 +1,148 @@
+package discovery
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"path"
+	"sort"
+)
+
+type ifaceInfo struct {
+	net.Interface
+	has4 bool
+	has6 bool
+}
+
+func (i ifaceInfo) has(v6 bool) bool {
+	if v6 {
+		return i.has6
+	}
+	return i.has4
+}
+
+func matchIface(pattern, name string) bool {
+	ok, err := path.Match(pattern, name)
+	return err == nil && ok
+}
+
+func validatePatterns(patterns []string) error {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("bad interface pattern %q: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// selectInterface reports whether ifi should be joined. Loopback interfaces
+// usually lack the multicast flag but still work when asked for by name.
+func (c *Config) selectInterface(ifi net.Interface) bool {
+	if ifi.Flags&net.FlagUp == 0 {
+		return false
+	}
+	for _, p := range c.ExcludeInterfaces {
+		if matchIface(p, ifi.Name) {
+			return false
+		}
+	}
+	if len(c.Interfaces) == 0 {
+		return ifi.Flags&net.FlagMulticast != 0
+	}
+	for _, p := range c.Interfaces {
+		if matchIface(p, ifi.Name) {
+			return ifi.Flags&(net.FlagMulticast|net.FlagLoopback) != 0
+		}
+	}
+	return false
+}
+
+func (c *Config) scanInterfaces(tr Transport) (map[int]ifaceInfo, error) {
+	all, err := tr.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("list interfaces: %w", err)
+	}
+	selected := make(map[int]ifaceInfo)
+	for _, ifi := range all {
+		if !c.selectInterface(ifi) {
+			continue
+		}
+		addrs, err := tr.InterfaceAddrs(ifi)
+		if err != nil {
+			continue
+		}
+		info := ifaceInfo{Interface: ifi}
+		for _, a := range addrs {
+			ipn, ok := a.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			if ipn.IP.To4() != nil {
+				info.has4 = true
+			} else {
+				info.has6 = true
+			}
+		}
+		selected[ifi.Index] = info
+	}
+	return selected, nil
+}
+
+func (d *Discovery) rescan() {
+	ifaces, err := d.cfg.scanInterfaces(d.transport)
+	if err != nil {
+		log.Println("discovery rescan:", err)
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for idx, ifi := range ifaces {
+		if _, ok := d.ifaces[idx]; !ok {
+			log.Println("discovery: using interface", ifi.Name)
+		}
+	}
+	for idx, ifi := range d.ifaces {
+		if _, ok := ifaces[idx]; !ok {
+			log.Println("discovery: dropping interface", ifi.Name)
+		}
+	}
+	d.ifaces = ifaces
+	for _, l := range d.listeners {
+		l.sync(ifaces)
+	}
+}
+
+func (d *Discovery) Interfaces() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	names := make([]string, 0, len(d.ifaces))
+	for _, ifi := range d.ifaces {
+		names = append(names, ifi.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (d *Discovery) ifaceName(idx int) string {
+	if ifi, ok := d.ifaces[idx]; ok {
+		return ifi.Name
+	}
+	if idx == 0 {
+		return "?"
+	}
+	return fmt.Sprintf("if%d", idx)
+}
+
+func (d *Discovery) interfaceList() []ifaceInfo {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	list := make([]ifaceInfo, 0, len(d.ifaces))
+	for _, ifi := range d.ifaces {
+		list = append(list, ifi)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Index < list[j].Index })
+	return list
+}
@@ -0,0 +1,91 @@
+package discovery
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metrics is always usable; without a Registerer the collectors simply are
+// not exported anywhere.
+type metrics struct {
+	livePeers      prometheus.Gauge
+	heartbeatsSent *prometheus.CounterVec
+	heartbeatsRecv *prometheus.CounterVec
+	joins          prometheus.Counter
+	leaves         prometheus.Counter
+	dropped        *prometheus.CounterVec
+	jitter         *prometheus.HistogramVec
+	electionTerm   prometheus.Gauge
+	isLeader       prometheus.Gauge
+}
+
+func newMetrics(reg prometheus.Registerer) (*metrics, error) {
+	m := &metrics{
+		livePeers: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "lab1_live_peers",
+			Help: "Current number of live peers",
+		}),
+		heartbeatsSent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "lab1_heartbeats_sent_total",
+			Help: "Heartbeat datagrams sent, per interface",
+		}, []string{"interface"}),
+		heartbeatsRecv: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "lab1_heartbeats_received_total",
+			Help: "Valid heartbeat datagrams received, per interface",
+		}, []string{"interface"}),
+		joins: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "lab1_peer_joins_total",
+			Help: "Number of peers that joined or restarted",
+		}),
+		leaves: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "lab1_peer_leaves_total",
+			Help: "Number of peers that left or timed out",
+		}),
+		dropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "lab1_dropped_datagrams_total",
+			Help: "Datagrams ignored on the group, by reason",
+		}, []string{"reason"}),
+		jitter: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "lab1_peer_jitter_seconds",
+			Help:    "Variation between consecutive heartbeat inter-arrival times, per peer",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 12),
+		}, []string{"peer"}),
+		electionTerm: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "lab1_election_term",
+			Help: "Current leader election term",
+		}),
+		isLeader: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "lab1_is_leader",
+			Help: "1 while this node is the elected leader",
+		}),
+	}
+	if reg == nil {
+		return m, nil
+	}
+	for _, c := range []prometheus.Collector{
+		m.livePeers, m.heartbeatsSent, m.heartbeatsRecv, m.joins, m.leaves, m.dropped, m.jitter, m.electionTerm, m.isLeader,
+	} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (m *metrics) observeJitter(id NodeID, jitter time.Duration) {
+	m.jitter.WithLabelValues(id.String()).Observe(jitter.Seconds())
+}
+
+func (m *metrics) setLeadership(term uint64, self bool) {
+	m.electionTerm.Set(float64(term))
+	if self {
+		m.isLeader.Set(1)
+	} else {
+		m.isLeader.Set(0)
+	}
+}
+
+func (m *metrics) forgetPeer(id NodeID) {
+	m.jitter.DeleteLabelValues(id.String())
+}
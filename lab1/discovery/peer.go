@@ -0,0 +1,429 @@
+package discovery
+
+import (
+	"maps"
+	"net"
+	"sort"
+	"time"
+)
+
+type Peer struct {
+	ID       NodeID            `json:"id"`
+	Hostname string            `json:"hostname"`
+	Label    string            `json:"label,omitempty"`
+	Meta     map[string]string `json:"meta,omitempty"`
+	Start    time.Time         `json:"start"`
+	Seq      uint64            `json:"seq"`
+	Addrs    []string          `json:"addrs"`
+	Groups   []string          `json:"groups"`
+	// Channels lists the source-specific (S, G) channels the peer was heard
+	// on; it stays empty for any-source groups.
+	Channels   []string  `json:"channels,omitempty"`
+	Interfaces []string  `json:"interfaces"`
+	FirstSeen  time.Time `json:"first_seen"`
+	LastSeen   time.Time `json:"last_seen"`
+	// Heartbeats counts distinct sequence numbers received since the peer
+	// (re)started; Loss is the fraction of sequence numbers never seen.
+	Heartbeats uint64  `json:"heartbeats"`
+	Loss       float64 `json:"loss"`
+	// Jitter is the smoothed variation of heartbeat inter-arrival times and
+	// RTT the smoothed echo round-trip time; RTT is zero when unmeasured.
+	Jitter time.Duration `json:"jitter_ns"`
+	RTT    time.Duration `json:"rtt_ns"`
+	// Suspect is set while the phi detector doubts the peer; Phi is its
+	// suspicion level at the last check.
+	Suspect bool    `json:"suspect"`
+	Phi     float64 `json:"phi"`
+	// Leader marks the peer this node currently follows.
+	Leader bool `json:"leader,omitempty"`
+}
+
+type EventType int
+
+const (
+	PeerJoined EventType = iota
+	PeerLeft
+	PeerRestarted
+	PeerAddrAdded
+	PeerSuspect
+	PeerRecovered
+	// LeaderChanged reports a new leader or term, or that the leader was
+	// lost; Event.Leadership holds the new view.
+	LeaderChanged
+)
+
+func (t EventType) String() string {
+	switch t {
+	case PeerJoined:
+		return "joined"
+	case PeerLeft:
+		return "left"
+	case PeerRestarted:
+		return "restarted"
+	case PeerAddrAdded:
+		return "addr-added"
+	case PeerSuspect:
+		return "suspect"
+	case PeerRecovered:
+		return "recovered"
+	case LeaderChanged:
+		return "leader"
+	default:
+		return "unknown"
+	}
+}
+
+// MatchMeta reports whether the peer advertises every key in filter with
+// the given value; an empty value only requires the key to be present.
+func (p Peer) MatchMeta(filter map[string]string) bool {
+	for k, want := range filter {
+		got, ok := p.Meta[k]
+		if !ok || (want != "" && got != want) {
+			return false
+		}
+	}
+	return true
+}
+
+func (t EventType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+type LeaveReason string
+
+const (
+	LeaveTimeout LeaveReason = "timeout"
+	LeaveGoodbye LeaveReason = "goodbye"
+)
+
+type Event struct {
+	Type EventType `json:"type"`
+	Peer Peer      `json:"peer"`
+	Addr string    `json:"addr,omitempty"`
+	Time time.Time `json:"time"`
+	// Reason tells for PeerLeft whether the peer said goodbye or went
+	// silent.
+	Reason LeaveReason `json:"reason,omitempty"`
+	// Leadership is set for LeaderChanged; Peer is then the leader, unless
+	// it is this node or unknown.
+	Leadership *Leadership `json:"leadership,omitempty"`
+}
+
+type packet struct {
+	hb  heartbeat
+	src *net.UDPAddr
+	// group is nil for heartbeats received by unicast, i.e. answers to a
+	// solicitation.
+	group   *net.UDPAddr
+	channel string
+	ifIndex int
+}
+
+type peer struct {
+	info      heartbeat
+	addrs     map[string]time.Time
+	groups    map[string]time.Time
+	channels  map[string]time.Time
+	ifaces    map[string]time.Time
+	firstSeen time.Time
+	lastSeen  time.Time
+	firstSeq  uint64
+	received  uint64
+
+	lastArrival time.Time
+	lastGap     time.Duration
+	jitter      time.Duration
+	lastSrc     *net.UDPAddr
+	rtt         time.Duration
+
+	arrivals arrivalWindow
+	suspect  bool
+	phi      float64
+}
+
+// observeArrival records a heartbeat with a new sequence number and returns
+// the RFC 3550 style jitter sample: the change in per-sequence
+// inter-arrival time. ok is false until two gaps have been seen.
+func (p *peer) observeArrival(seq uint64, now time.Time) (jitter time.Duration, ok bool) {
+	prevSeq := p.info.Seq
+	prevArrival := p.lastArrival
+	p.lastArrival = now
+	if prevArrival.IsZero() || seq <= prevSeq {
+		return 0, false
+	}
+	gap := now.Sub(prevArrival) / time.Duration(seq-prevSeq)
+	prevGap := p.lastGap
+	p.lastGap = gap
+	if prevGap == 0 {
+		return 0, false
+	}
+	jitter = gap - prevGap
+	if jitter < 0 {
+		jitter = -jitter
+	}
+	return jitter, true
+}
+
+func (p *peer) loss() float64 {
+	expected := p.info.Seq - p.firstSeq + 1
+	if p.received == 0 || expected <= p.received {
+		return 0
+	}
+	return 1 - float64(p.received)/float64(expected)
+}
+
+func (p *peer) snapshot() Peer {
+	return Peer{
+		ID:         p.info.NodeID,
+		Hostname:   p.info.Hostname,
+		Label:      p.info.Label,
+		Meta:       maps.Clone(p.info.Meta),
+		Start:      p.info.Start,
+		Seq:        p.info.Seq,
+		Addrs:      sortedKeys(p.addrs),
+		Groups:     sortedKeys(p.groups),
+		Channels:   sortedKeys(p.channels),
+		Interfaces: sortedKeys(p.ifaces),
+		FirstSeen:  p.firstSeen,
+		LastSeen:   p.lastSeen,
+		Heartbeats: p.received,
+		Loss:       p.loss(),
+		Jitter:     p.jitter,
+		RTT:        p.rtt,
+		Suspect:    p.suspect,
+		Phi:        p.phi,
+	}
+}
+
+func (d *Discovery) handlePacket(pkt packet, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// Sockets bound to a group also see datagrams arriving on interfaces
+	// that were never joined; honour the interface selection here.
+	if _, ok := d.ifaces[pkt.ifIndex]; !ok && pkt.ifIndex != 0 {
+		return
+	}
+
+	ifName := d.ifaceName(pkt.ifIndex)
+	d.metrics.heartbeatsRecv.WithLabelValues(ifName).Inc()
+
+	// Copies of the last heartbeat can still arrive over other groups after
+	// the goodbye; they must not resurrect the peer.
+	if g, ok := d.gone[pkt.hb.NodeID]; ok {
+		if g.start.Equal(pkt.hb.Start) {
+			return
+		}
+		delete(d.gone, pkt.hb.NodeID)
+	}
+
+	addr := pkt.src.String()
+	p, ex := d.peers[pkt.hb.NodeID]
+	var ev *Event
+	switch {
+	case !ex:
+		p = &peer{
+			addrs:     make(map[string]time.Time),
+			groups:    make(map[string]time.Time),
+			channels:  make(map[string]time.Time),
+			ifaces:    make(map[string]time.Time),
+			firstSeen: now,
+		}
+		d.peers[pkt.hb.NodeID] = p
+		ev = &Event{Type: PeerJoined}
+	case !p.info.Start.Equal(pkt.hb.Start):
+		clear(p.addrs)
+		clear(p.groups)
+		clear(p.channels)
+		clear(p.ifaces)
+		ev = &Event{Type: PeerRestarted}
+	default:
+		if _, known := p.addrs[addr]; !known {
+			ev = &Event{Type: PeerAddrAdded}
+		}
+	}
+	// The same heartbeat arrives once per group and interface it was sent
+	// on; only the first copy of a sequence number counts.
+	switch {
+	case ev != nil && ev.Type != PeerAddrAdded:
+		p.firstSeq = pkt.hb.Seq
+		p.received = 1
+		p.lastArrival = now
+		p.lastGap = 0
+		p.jitter = 0
+		p.rtt = 0
+		p.arrivals.reset()
+		if t, ok := d.timedOut[pkt.hb.NodeID]; ok && ev.Type == PeerJoined && t.start.Equal(pkt.hb.Start) {
+			p.arrivals = t.arrivals
+		}
+		delete(d.timedOut, pkt.hb.NodeID)
+		p.info = pkt.hb
+		d.metrics.joins.Inc()
+		d.metrics.forgetPeer(pkt.hb.NodeID)
+	case pkt.hb.Seq > p.info.Seq:
+		p.arrivals.add(now.Sub(p.lastArrival))
+		if jitter, ok := p.observeArrival(pkt.hb.Seq, now); ok {
+			p.jitter += (jitter - p.jitter) / 16
+			d.metrics.observeJitter(pkt.hb.NodeID, jitter)
+		}
+		p.received++
+		p.info = pkt.hb
+	}
+	p.addrs[addr] = now
+	p.lastSrc = pkt.src
+	if pkt.group != nil {
+		p.groups[pkt.group.String()] = now
+	}
+	if pkt.channel != "" {
+		p.channels[pkt.channel] = now
+	}
+	p.ifaces[ifName] = now
+	d.metrics.livePeers.Set(float64(len(d.peers)))
+	p.lastSeen = now
+	if pkt.hb.Election != nil {
+		d.observeBallot(pkt.hb.NodeID, *pkt.hb.Election, now)
+	}
+
+	if p.suspect {
+		p.suspect = false
+		p.phi = 0
+		if ev == nil {
+			ev = &Event{Type: PeerRecovered}
+		}
+	}
+
+	if ev != nil {
+		ev.Peer = p.snapshot()
+		ev.Addr = addr
+		ev.Time = now
+		d.publish(*ev)
+	}
+}
+
+type goneEntry struct {
+	start time.Time
+	at    time.Time
+}
+
+func (d *Discovery) handleGoodbye(hb heartbeat, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	p, ok := d.peers[hb.NodeID]
+	if !ok || !p.info.Start.Equal(hb.Start) {
+		return
+	}
+	d.removePeer(hb.NodeID, p, now, LeaveGoodbye)
+	d.gone[hb.NodeID] = goneEntry{start: hb.Start, at: now}
+}
+
+// removePeer must be called with d.mu held.
+func (d *Discovery) removePeer(id NodeID, p *peer, now time.Time, reason LeaveReason) {
+	delete(d.peers, id)
+	d.metrics.leaves.Inc()
+	d.metrics.forgetPeer(id)
+	d.metrics.livePeers.Set(float64(len(d.peers)))
+	d.publish(Event{Type: PeerLeft, Peer: p.snapshot(), Time: now, Reason: reason})
+	d.checkLeader(now)
+}
+
+func (d *Discovery) expire(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for id, g := range d.gone {
+		if now.Sub(g.at) > d.cfg.Timeout {
+			delete(d.gone, id)
+		}
+	}
+	for id, t := range d.timedOut {
+		if now.Sub(t.at) > phiMemory {
+			delete(d.timedOut, id)
+		}
+	}
+
+	for id, p := range d.peers {
+		switch d.health(p, now) {
+		case suspect:
+			if !p.suspect {
+				p.suspect = true
+				d.publish(Event{Type: PeerSuspect, Peer: p.snapshot(), Time: now})
+			}
+		case dead:
+			if d.cfg.Detector == DetectorPhi {
+				d.timedOut[id] = timedOutPeer{start: p.info.Start, at: now, arrivals: p.arrivals}
+			}
+			d.removePeer(id, p, now, LeaveTimeout)
+			continue
+		}
+		expireKeys(p.addrs, now, d.cfg.Timeout)
+		expireKeys(p.groups, now, d.cfg.Timeout)
+		expireKeys(p.channels, now, d.cfg.Timeout)
+		expireKeys(p.ifaces, now, d.cfg.Timeout)
+	}
+	d.checkLeader(now)
+}
+
+func sortedKeys(m map[string]time.Time) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func expireKeys(m map[string]time.Time, now time.Time, timeout time.Duration) {
+	for k, last := range m {
+		if now.Sub(last) > timeout {
+			delete(m, k)
+		}
+	}
+}
+
+func (d *Discovery) Peers() []Peer {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	peers := make([]Peer, 0, len(d.peers))
+	leader := d.leadership().Leader
+	for id, p := range d.peers {
+		s := p.snapshot()
+		s.Leader = id == leader
+		peers = append(peers, s)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].ID.String() < peers[j].ID.String() })
+	return peers
+}
+
+func (d *Discovery) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, 64)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stopped {
+		close(ch)
+		return ch, func() {}
+	}
+	d.subs[ch] = struct{}{}
+
+	return ch, func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if _, ok := d.subs[ch]; ok {
+			delete(d.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// publish must be called with d.mu held. Slow subscribers lose events
+// instead of stalling the receive loop.
+func (d *Discovery) publish(ev Event) {
+	for ch := range d.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package discovery
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+type Detector string
+
+const (
+	// DetectorTimeout declares a peer dead once nothing was heard from it
+	// for Config.Timeout.
+	DetectorTimeout Detector = "timeout"
+	// DetectorPhi is the phi-accrual failure detector (Hayashibara et al.):
+	// suspicion grows with how unlikely the current silence is given the
+	// recently observed heartbeat intervals.
+	DetectorPhi Detector = "phi"
+)
+
+const (
+	DefaultPhiThreshold = 8.0
+	DefaultPhiSuspect   = 3.0
+
+	phiWindowSize = 100
+	// phiMinSamples intervals are needed before phi is trusted; until then
+	// the fixed timeout applies.
+	phiMinSamples = 3
+	// The standard deviation of the intervals is taken to be at least
+	// Interval/phiMinStdDivisor.
+	phiMinStdDivisor = 2
+	// phiMemory is how long the intervals of a peer declared dead are kept
+	// in case it turns out to be alive.
+	phiMemory = 5 * time.Minute
+)
+
+func ParseDetector(s string) (Detector, error) {
+	switch d := Detector(s); d {
+	case DetectorTimeout, DetectorPhi:
+		return d, nil
+	default:
+		return "", fmt.Errorf("unknown detector %q, want %q or %q", s, DetectorTimeout, DetectorPhi)
+	}
+}
+
+type health int
+
+const (
+	healthy health = iota
+	suspect
+	dead
+)
+
+// arrivalWindow keeps the last phiWindowSize heartbeat intervals in seconds.
+type arrivalWindow struct {
+	intervals [phiWindowSize]float64
+	next      int
+	n         int
+	sum       float64
+	sumSq     float64
+}
+
+func (w *arrivalWindow) add(interval time.Duration) {
+	x := interval.Seconds()
+	if w.n == phiWindowSize {
+		old := w.intervals[w.next]
+		w.sum -= old
+		w.sumSq -= old * old
+	} else {
+		w.n++
+	}
+	w.intervals[w.next] = x
+	w.next = (w.next + 1) % phiWindowSize
+	w.sum += x
+	w.sumSq += x * x
+}
+
+func (w *arrivalWindow) reset() {
+	*w = arrivalWindow{}
+}
+
+// phi returns -log10 of the probability that a heartbeat arrives later
+// than elapsed, modelling intervals as normally distributed. As in Akka,
+// pause is added to the mean so that a lost heartbeat or two cost little
+// suspicion, and the standard deviation is at least minStd so that a
+// perfectly regular sender does not turn every small delay into a failure.
+func (w *arrivalWindow) phi(elapsed, pause, minStd time.Duration) float64 {
+	mean := w.sum / float64(w.n)
+	std := math.Sqrt(math.Max(w.sumSq/float64(w.n)-mean*mean, 0))
+	std = math.Max(std, minStd.Seconds())
+	mean += pause.Seconds()
+
+	y := (elapsed.Seconds() - mean) / std
+	// Logistic approximation of the normal CDF, as used by Cassandra and Akka.
+	e := math.Exp(-y * (1.5976 + 0.070566*y*y))
+	if elapsed.Seconds() > mean {
+		return -math.Log10(e / (1 + e))
+	}
+	return -math.Log10(1 - 1/(1+e))
+}
+
+func (d *Discovery) health(p *peer, now time.Time) health {
+	elapsed := now.Sub(p.lastSeen)
+	if d.cfg.Detector != DetectorPhi || p.arrivals.n < phiMinSamples {
+		p.phi = 0
+		if elapsed > d.cfg.Timeout {
+			return dead
+		}
+		return healthy
+	}
+
+	p.phi = p.arrivals.phi(elapsed, d.cfg.PhiPause, d.cfg.Interval/phiMinStdDivisor)
+	switch {
+	case p.phi >= d.cfg.PhiThreshold:
+		return dead
+	case p.phi >= d.cfg.PhiSuspect:
+		return suspect
+	default:
+		return healthy
+	}
+}
+
+// timedOutPeer remembers the intervals of a peer the phi detector declared
+// dead, so that if the same incarnation comes back the detector carries on
+// from what it learned rather than starting afresh.
+type timedOutPeer struct {
+	start    time.Time
+	at       time.Time
+	arrivals arrivalWindow
+}
@@ -0,0 +1,34 @@
+package discovery
+
+import (
+	"testing"
+	"time"
+)
+
+// TestPhiRegularSender follows a peer sending exactly every 2s with the
+// default settings: two lost heartbeats must not raise suspicion, and a
+// peer silent for five intervals must be declared dead.
+func TestPhiRegularSender(t *testing.T) {
+	const interval = 2 * time.Second
+	var w arrivalWindow
+	for range 50 {
+		w.add(interval)
+	}
+	for _, tc := range []struct {
+		elapsed time.Duration
+		min     float64
+		max     float64
+	}{
+		{interval, 0, 0.1},
+		// The next heartbeat after a lost one.
+		{2*interval + 100*time.Millisecond, 0, 1},
+		{3 * interval, 0, DefaultPhiSuspect},
+		{4 * interval, DefaultPhiSuspect, DefaultPhiThreshold},
+		{5 * interval, DefaultPhiThreshold, 1e9},
+	} {
+		phi := w.phi(tc.elapsed, interval, interval/phiMinStdDivisor)
+		if phi < tc.min || phi > tc.max {
+			t.Errorf("phi after %s = %.2f, want %.1f..%.1f", tc.elapsed, phi, tc.min, tc.max)
+		}
+	}
+}
@@ -0,0 +1,510 @@
+package discovery
+
+import (
+	"bytes"
+	"container/heap"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"testing"
+	"testing/synctest"
+	"time"
+)
+
+// The simulation runs every node of a test against one virtual clock and
+// one virtual LAN. Each scheduled action (a ticker firing, a datagram
+// arriving) runs on its own and the harness waits with synctest.Wait until
+// every node goroutine is blocked again before taking the next one, so a
+// run depends on nothing but the seed.
+
+type simTimer struct {
+	at      time.Time
+	seq     uint64
+	period  time.Duration
+	fire    func(now time.Time)
+	stopped bool
+	index   int
+}
+
+type timerQueue []*simTimer
+
+func (q timerQueue) Len() int { return len(q) }
+func (q timerQueue) Less(i, j int) bool {
+	if q[i].at.Equal(q[j].at) {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].at.Before(q[j].at)
+}
+func (q timerQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index, q[j].index = i, j
+}
+func (q *timerQueue) Push(x any) {
+	t := x.(*simTimer)
+	t.index = len(*q)
+	*q = append(*q, t)
+}
+func (q *timerQueue) Pop() any {
+	old := *q
+	t := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return t
+}
+
+type simClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	seq   uint64
+	queue timerQueue
+}
+
+func newSimClock() *simClock {
+	return &simClock{now: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *simClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// schedule must be called with c.mu held.
+func (c *simClock) schedule(t *simTimer) {
+	c.seq++
+	t.seq = c.seq
+	heap.Push(&c.queue, t)
+}
+
+func (c *simClock) after(d time.Duration, fn func(now time.Time)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.schedule(&simTimer{at: c.now.Add(d), fire: fn})
+}
+
+func (c *simClock) NewTicker(d time.Duration) Ticker {
+	t := &simTicker{clock: c, ch: make(chan time.Time, 1)}
+	t.timer = &simTimer{period: d, fire: func(now time.Time) {
+		// Like time.Ticker, drop ticks the receiver is not ready for.
+		select {
+		case t.ch <- now:
+		default:
+		}
+	}}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t.timer.at = c.now.Add(d)
+	c.schedule(t.timer)
+	return t
+}
+
+// Advance runs everything scheduled up to now+d in order.
+func (c *simClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	c.mu.Unlock()
+	for {
+		c.mu.Lock()
+		if len(c.queue) == 0 || c.queue[0].at.After(end) {
+			c.now = end
+			c.mu.Unlock()
+			synctest.Wait()
+			return
+		}
+		t := heap.Pop(&c.queue).(*simTimer)
+		if t.stopped {
+			c.mu.Unlock()
+			continue
+		}
+		c.now = t.at
+		if t.period > 0 {
+			t.at = t.at.Add(t.period)
+			c.schedule(t)
+		}
+		now := c.now
+		c.mu.Unlock()
+
+		t.fire(now)
+		synctest.Wait()
+	}
+}
+
+type simTicker struct {
+	clock *simClock
+	timer *simTimer
+	ch    chan time.Time
+}
+
+func (t *simTicker) C() <-chan time.Time { return t.ch }
+
+func (t *simTicker) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	t.timer.stopped = true
+}
+
+const simIfIndex = 1
+
+var simIface = net.Interface{Index: simIfIndex, MTU: 1500, Name: "sim0", Flags: net.FlagUp | net.FlagMulticast}
+
+// simNet is a single multicast-capable segment with configurable loss,
+// delay and partitions. Every host has one interface with an IPv4 and an
+// IPv6 address.
+type simNet struct {
+	clock *simClock
+
+	mu       sync.Mutex
+	rng      *rand.Rand
+	loss     float64
+	delay    time.Duration
+	jitter   time.Duration
+	hosts    []*simHost
+	conns    []*simConn
+	cut      map[[2]int]bool
+	nextPort int
+}
+
+func newSimNet(seed uint64) *simNet {
+	return &simNet{
+		clock:    newSimClock(),
+		rng:      rand.New(rand.NewPCG(seed, seed)),
+		cut:      make(map[[2]int]bool),
+		nextPort: 40000,
+	}
+}
+
+func (n *simNet) setLoss(p float64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.loss = p
+}
+
+func (n *simNet) setDelay(delay, jitter time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.delay, n.jitter = delay, jitter
+}
+
+// partition cuts every link between the two sides until heal.
+func (n *simNet) partition(a, b []*simHost) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, x := range a {
+		for _, y := range b {
+			n.cut[linkKey(x, y)] = true
+		}
+	}
+}
+
+func (n *simNet) heal() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	clear(n.cut)
+}
+
+func linkKey(a, b *simHost) [2]int {
+	if a.index > b.index {
+		a, b = b, a
+	}
+	return [2]int{a.index, b.index}
+}
+
+func (n *simNet) addHost() *simHost {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	i := len(n.hosts)
+	h := &simHost{
+		net:   n,
+		index: i,
+		ip4:   net.IPv4(10, 0, 0, byte(i+1)).To4(),
+		ip6:   net.ParseIP(fmt.Sprintf("fd00::%x", i+1)),
+	}
+	n.hosts = append(n.hosts, h)
+	return h
+}
+
+// route hands a copy of b to every socket that would receive it on a real
+// LAN, after the configured delay.
+func (n *simNet) route(from *simConn, b []byte, dst *net.UDPAddr) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if from.host.down {
+		return
+	}
+	for _, c := range n.conns {
+		if c.v6 != from.v6 || !c.accepts(from, dst) {
+			continue
+		}
+		if c.host != from.host {
+			if c.host.down || n.cut[linkKey(c.host, from.host)] || n.rng.Float64() < n.loss {
+				continue
+			}
+		}
+		delay := n.delay
+		if n.jitter > 0 {
+			delay += time.Duration(n.rng.Int64N(int64(n.jitter)))
+		}
+		data, src := bytes.Clone(b), from.local
+		n.clock.after(delay, func(time.Time) { c.deliver(data, src) })
+	}
+}
+
+type simHost struct {
+	net   *simNet
+	index int
+	ip4   net.IP
+	ip6   net.IP
+	// down makes the host silently drop off the network, like a crash.
+	down bool
+}
+
+func (h *simHost) ip(v6 bool) net.IP {
+	if v6 {
+		return h.ip6
+	}
+	return h.ip4
+}
+
+func (h *simHost) Interfaces() ([]net.Interface, error) {
+	return []net.Interface{simIface}, nil
+}
+
+func (h *simHost) InterfaceAddrs(ifi net.Interface) ([]net.Addr, error) {
+	return []net.Addr{
+		&net.IPNet{IP: h.ip4, Mask: net.CIDRMask(24, 32)},
+		&net.IPNet{IP: h.ip6, Mask: net.CIDRMask(64, 128)},
+	}, nil
+}
+
+func (h *simHost) Listen(v6 bool, laddr string) (PacketConn, error) {
+	addr, err := net.ResolveUDPAddr("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	n := h.net
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	c := &simConn{
+		host:     h,
+		v6:       v6,
+		joined:   make(map[string][]net.IP),
+		loopback: true,
+		queue:    make(chan simDatagram, 256),
+		closed:   make(chan struct{}),
+	}
+	if addr.IP.IsMulticast() {
+		c.group = addr
+	}
+	port := addr.Port
+	if port == 0 {
+		port = n.nextPort
+		n.nextPort++
+	}
+	c.local = &net.UDPAddr{IP: h.ip(v6), Port: port}
+	n.conns = append(n.conns, c)
+	return c, nil
+}
+
+type simDatagram struct {
+	data []byte
+	src  *net.UDPAddr
+}
+
+type simConn struct {
+	host  *simHost
+	v6    bool
+	local *net.UDPAddr
+	// group is set for sockets bound to a multicast group; joined maps the
+	// groups to their sources, nil for any-source joins.
+	group    *net.UDPAddr
+	joined   map[string][]net.IP
+	loopback bool
+
+	queue     chan simDatagram
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// accepts must be called with the simNet lock held.
+func (c *simConn) accepts(from *simConn, dst *net.UDPAddr) bool {
+	if !dst.IP.IsMulticast() {
+		return c.group == nil && c.local.IP.Equal(dst.IP) && c.local.Port == dst.Port
+	}
+	if c.group == nil || !c.group.IP.Equal(dst.IP) || c.group.Port != dst.Port {
+		return false
+	}
+	if c.host == from.host && !from.loopback {
+		return false
+	}
+	sources, ok := c.joined[dst.IP.String()]
+	if !ok {
+		return false
+	}
+	if sources == nil {
+		return true
+	}
+	for _, s := range sources {
+		if s.Equal(from.local.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *simConn) deliver(data []byte, src *net.UDPAddr) {
+	select {
+	case <-c.closed:
+	case c.queue <- simDatagram{data: data, src: src}:
+	default:
+		// A full socket buffer drops the datagram.
+	}
+}
+
+func (c *simConn) ReadPacket(b []byte) (int, int, net.Addr, error) {
+	select {
+	case <-c.closed:
+		return 0, 0, nil, net.ErrClosed
+	case dg := <-c.queue:
+		return copy(b, dg.data), simIfIndex, dg.src, nil
+	}
+}
+
+func (c *simConn) WritePacket(b []byte, dst net.Addr) (int, error) {
+	udp, ok := dst.(*net.UDPAddr)
+	if !ok {
+		return 0, fmt.Errorf("sim: unsupported address %v", dst)
+	}
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	c.host.net.route(c, b, udp)
+	return len(b), nil
+}
+
+func (c *simConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *simConn) join(group net.Addr, sources []net.IP) error {
+	udp, ok := group.(*net.UDPAddr)
+	if !ok {
+		return fmt.Errorf("sim: unsupported group %v", group)
+	}
+	c.host.net.mu.Lock()
+	defer c.host.net.mu.Unlock()
+	c.joined[udp.IP.String()] = append(c.joined[udp.IP.String()], sources...)
+	return nil
+}
+
+func (c *simConn) JoinGroup(ifi *net.Interface, group net.Addr) error {
+	return c.join(group, nil)
+}
+
+func (c *simConn) JoinSourceSpecificGroup(ifi *net.Interface, group, source net.Addr) error {
+	return c.join(group, []net.IP{source.(*net.IPAddr).IP})
+}
+
+func (c *simConn) LeaveGroup(ifi *net.Interface, group net.Addr) error {
+	c.host.net.mu.Lock()
+	defer c.host.net.mu.Unlock()
+	delete(c.joined, group.(*net.UDPAddr).IP.String())
+	return nil
+}
+
+func (c *simConn) LeaveSourceSpecificGroup(ifi *net.Interface, group, source net.Addr) error {
+	return c.LeaveGroup(ifi, group)
+}
+
+func (c *simConn) SetMulticastInterface(ifi *net.Interface) error { return nil }
+
+func (c *simConn) SetMulticastHops(hops int) error { return nil }
+
+func (c *simConn) SetMulticastLoopback(on bool) error {
+	c.host.net.mu.Lock()
+	defer c.host.net.mu.Unlock()
+	c.loopback = on
+	return nil
+}
+
+// simNode is one Discovery on its own simulated host, with every event it
+// published.
+type simNode struct {
+	d    *Discovery
+	host *simHost
+
+	mu     sync.Mutex
+	events []Event
+	done   chan struct{}
+}
+
+// addNode creates a node; cfg only needs the detector settings, the rest
+// is filled in.
+func (n *simNet) addNode(t *testing.T, cfg Config) *simNode {
+	t.Helper()
+	h := n.addHost()
+	cfg.NodeID = NodeID{0: byte(h.index + 1)}
+	cfg.Hostname = fmt.Sprintf("node%d", h.index+1)
+	cfg.Clock = n.clock
+	cfg.Transport = h
+	d, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return &simNode{d: d, host: h, done: make(chan struct{})}
+}
+
+func (s *simNode) start(t *testing.T) {
+	t.Helper()
+	events, _ := s.d.Subscribe()
+	go func() {
+		defer close(s.done)
+		for ev := range events {
+			s.mu.Lock()
+			s.events = append(s.events, ev)
+			s.mu.Unlock()
+		}
+	}()
+	if err := s.d.Start(t.Context()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	synctest.Wait()
+}
+
+// stop shuts the node down gracefully, announcing its leave.
+func (s *simNode) stop() {
+	s.d.Stop()
+	<-s.done
+}
+
+// crash takes the host off the network without a goodbye.
+func (s *simNode) crash() {
+	s.host.net.mu.Lock()
+	s.host.down = true
+	s.host.net.mu.Unlock()
+	s.stop()
+}
+
+// eventsFor returns the events of type typ about peer.
+func (s *simNode) eventsFor(typ EventType, peer *simNode) []Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []Event
+	for _, ev := range s.events {
+		if ev.Type == typ && ev.Peer.ID == peer.d.ID() {
+			out = append(out, ev)
+		}
+	}
+	return out
+}
+
+func (s *simNode) hasPeer(peer *simNode) bool {
+	for _, p := range s.d.Peers() {
+		if p.ID == peer.d.ID() {
+			return true
+		}
+	}
+	return false
+}
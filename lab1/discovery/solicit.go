@@ -0,0 +1,41 @@
+package discovery
+
+import (
+	"log"
+	"net"
+)
+
+// Solicit multicasts a request asking every running node to answer with a
+// unicast heartbeat right away, so that a short-lived query does not have
+// to wait for the next regular heartbeat of each peer.
+func (d *Discovery) Solicit() {
+	req := d.self
+	req.Type = msgSolicit
+	req.Seq = 0
+	req.Meta = nil
+	msg, err := req.MarshalBinary()
+	if err != nil {
+		log.Println("solicit encode:", err)
+		return
+	}
+	d.broadcast(msg)
+}
+
+func (d *Discovery) answerSolicit(src *net.UDPAddr) {
+	hb := d.self
+	hb.Seq = d.seq.Load()
+	hb.Election = d.ballot()
+	msg, err := hb.MarshalBinary()
+	if err != nil {
+		log.Println("solicit answer encode:", err)
+		return
+	}
+	for _, s := range d.senders {
+		if s.v6 != isV6(src) {
+			continue
+		}
+		if err := d.send(s.conn, msg, src); err != nil {
+			log.Printf("solicit answer to %s: %v", src, err)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package discovery
+
+import (
+	"net"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Clock is the time source of a Discovery. Everything that is timed, from
+// heartbeats to peer expiry, goes through it, so a simulated clock makes
+// runs reproducible.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) NewTicker(d time.Duration) Ticker { return systemTicker{time.NewTicker(d)} }
+
+type systemTicker struct{ *time.Ticker }
+
+func (t systemTicker) C() <-chan time.Time { return t.Ticker.C }
+
+// Transport opens the sockets discovery talks through and enumerates the
+// interfaces it may use. Listen binds to laddr: a group address for the
+// multicast listeners, a wildcard address for the per-family sockets that
+// send heartbeats and carry unicast traffic.
+type Transport interface {
+	Listen(v6 bool, laddr string) (PacketConn, error)
+	Interfaces() ([]net.Interface, error)
+	InterfaceAddrs(ifi net.Interface) ([]net.Addr, error)
+}
+
+// PacketConn hides the differences between ipv4.PacketConn and
+// ipv6.PacketConn so that both families share the join and send logic.
+// ReadPacket reports the index of the interface a datagram arrived on, or
+// zero when unknown.
+type PacketConn interface {
+	JoinGroup(ifi *net.Interface, group net.Addr) error
+	LeaveGroup(ifi *net.Interface, group net.Addr) error
+	JoinSourceSpecificGroup(ifi *net.Interface, group, source net.Addr) error
+	LeaveSourceSpecificGroup(ifi *net.Interface, group, source net.Addr) error
+	SetMulticastInterface(ifi *net.Interface) error
+	SetMulticastLoopback(on bool) error
+	SetMulticastHops(hops int) error
+	ReadPacket(b []byte) (n, ifIndex int, src net.Addr, err error)
+	WritePacket(b []byte, dst net.Addr) (int, error)
+	Close() error
+}
+
+type systemTransport struct{}
+
+func (systemTransport) Interfaces() ([]net.Interface, error) { return net.Interfaces() }
+
+func (systemTransport) InterfaceAddrs(ifi net.Interface) ([]net.Addr, error) { return ifi.Addrs() }
+
+// Listen binds to laddr and wraps the socket for multicast control.
+// Binding to the group address itself lets several nodes share a port on
+// one host and keeps datagrams of other groups out.
+func (systemTransport) Listen(v6 bool, laddr string) (PacketConn, error) {
+	if !v6 {
+		pc, err := net.ListenPacket("udp4", laddr)
+		if err != nil {
+			return nil, err
+		}
+		pc.(*net.UDPConn).SetReadBuffer(1 << 20)
+		p := ipv4.NewPacketConn(pc)
+		if err := p.SetControlMessage(ipv4.FlagInterface, true); err != nil {
+			pc.Close()
+			return nil, err
+		}
+		return conn4{p}, nil
+	}
+	pc, err := net.ListenPacket("udp6", laddr)
+	if err != nil {
+		return nil, err
+	}
+	pc.(*net.UDPConn).SetReadBuffer(1 << 20)
+	p := ipv6.NewPacketConn(pc)
+	if err := p.SetControlMessage(ipv6.FlagInterface, true); err != nil {
+		pc.Close()
+		return nil, err
+	}
+	return conn6{p}, nil
+}
+
+type conn4 struct{ *ipv4.PacketConn }
+
+func (c conn4) ReadPacket(b []byte) (int, int, net.Addr, error) {
+	n, cm, src, err := c.ReadFrom(b)
+	if cm == nil {
+		return n, 0, src, err
+	}
+	return n, cm.IfIndex, src, err
+}
+
+func (c conn4) WritePacket(b []byte, dst net.Addr) (int, error) {
+	return c.WriteTo(b, nil, dst)
+}
+
+func (c conn4) SetMulticastHops(hops int) error {
+	return c.SetMulticastTTL(hops)
+}
+
+type conn6 struct{ *ipv6.PacketConn }
+
+func (c conn6) ReadPacket(b []byte) (int, int, net.Addr, error) {
+	n, cm, src, err := c.ReadFrom(b)
+	if cm == nil {
+		return n, 0, src, err
+	}
+	return n, cm.IfIndex, src, err
+}
+
+func (c conn6) WritePacket(b []byte, dst net.Addr) (int, error) {
+	return c.WriteTo(b, nil, dst)
+}
+
+func (c conn6) SetMulticastHops(hops int) error {
+	return c.SetMulticastHopLimit(hops)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// listFlag collects values from repeated and comma-separated occurrences,
+// e.g. -iface eth0 -iface 'wl*,en*'.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(s string) error {
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			*l = append(*l, part)
+		}
+	}
+	return nil
+}
+
+// kvFlag collects key=value pairs from repeated occurrences. With
+// allowBare a plain "key" is stored with an empty value.
+type kvFlag struct {
+	m         map[string]string
+	allowBare bool
+}
+
+func (f *kvFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	parts := make([]string, 0, len(f.m))
+	for k, v := range f.m {
+		parts = append(parts, k+"="+v)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+func (f *kvFlag) Set(s string) error {
+	k, v, ok := strings.Cut(s, "=")
+	k = strings.TrimSpace(k)
+	if k == "" || (!ok && !f.allowBare) {
+		return fmt.Errorf("want key=value, got %q", s)
+	}
+	if f.m == nil {
+		f.m = make(map[string]string)
+	}
+	f.m[k] = strings.TrimSpace(v)
+	return nil
+}
+
+// loadMetaFile reads key=value lines; blank lines and lines starting with
+// '#' are skipped.
+func loadMetaFile(path string, into *kvFlag) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := into.Set(line); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+	}
+	return sc.Err()
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"networks_nsu/lab1/discovery"
+)
+
+// Records written by the observer itself; they bound the periods in which
+// the log says anything about other nodes.
+const (
+	historyStart = "start"
+	historyStop  = "stop"
+)
+
+type historyRecord struct {
+	Time     time.Time        `json:"time"`
+	Event    string           `json:"event"`
+	ID       discovery.NodeID `json:"id"`
+	Hostname string           `json:"hostname,omitempty"`
+	Addrs    []string         `json:"addrs,omitempty"`
+	Reason   string           `json:"reason,omitempty"`
+}
+
+// historyLog appends peer churn to a JSON Lines file so it survives the
+// process.
+type historyLog struct {
+	f   *os.File
+	enc *json.Encoder
+}
+
+func openHistory(path string, self discovery.NodeID) (*historyLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	h := &historyLog{f: f, enc: json.NewEncoder(f)}
+	if err := h.write(historyRecord{Time: time.Now(), Event: historyStart, ID: self}); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *historyLog) write(rec historyRecord) error {
+	return h.enc.Encode(rec)
+}
+
+// record logs the events that change a peer's availability; others, such as
+// a new address, are skipped.
+func (h *historyLog) record(ev discovery.Event) error {
+	switch ev.Type {
+	case discovery.PeerJoined, discovery.PeerLeft, discovery.PeerRestarted,
+		discovery.PeerSuspect, discovery.PeerRecovered:
+	default:
+		return nil
+	}
+	return h.write(historyRecord{
+		Time:     ev.Time,
+		Event:    ev.Type.String(),
+		ID:       ev.Peer.ID,
+		Hostname: ev.Peer.Hostname,
+		Addrs:    ev.Peer.Addrs,
+		Reason:   string(ev.Reason),
+	})
+}
+
+func (h *historyLog) Close(self discovery.NodeID) error {
+	err := h.write(historyRecord{Time: time.Now(), Event: historyStop, ID: self})
+	if cerr := h.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+type uptime struct {
+	id       discovery.NodeID
+	hostname string
+
+	observed      time.Duration
+	up            time.Duration
+	flaps         int
+	suspects      int
+	longestOutage time.Duration
+
+	seen     bool
+	isUp     bool
+	since    time.Time
+	downFrom time.Time
+}
+
+func (u *uptime) availability() float64 {
+	if u.observed <= 0 {
+		return 0
+	}
+	return float64(u.up) / float64(u.observed)
+}
+
+// advance accounts the time between the last change and now to the state
+// the node was in.
+func (u *uptime) advance(now time.Time) {
+	if !u.seen || now.Before(u.since) {
+		return
+	}
+	d := now.Sub(u.since)
+	u.observed += d
+	if u.isUp {
+		u.up += d
+	} else if out := now.Sub(u.downFrom); out > u.longestOutage {
+		u.longestOutage = out
+	}
+	u.since = now
+}
+
+func (u *uptime) setUp(now time.Time, up bool) {
+	u.advance(now)
+	if !u.seen {
+		u.seen = true
+		u.since = now
+	}
+	if u.isUp && !up {
+		u.flaps++
+		u.downFrom = now
+	}
+	u.isUp = up
+}
+
+// replayHistory reconstructs per-node uptime statistics from a history
+// log. Time is only accounted while an observer was running and after the
+// node was first seen; an outage still open when the observer stopped ends
+// there.
+func replayHistory(r io.Reader) ([]*uptime, error) {
+	nodes := make(map[discovery.NodeID]*uptime)
+	observer := false
+	var last time.Time
+
+	closeWindow := func(at time.Time) {
+		for _, u := range nodes {
+			u.advance(at)
+			// Nothing is known until the next observer sees the node again.
+			u.isUp = false
+			u.downFrom = at
+			u.seen = false
+		}
+		observer = false
+	}
+	node := func(rec historyRecord) *uptime {
+		u, ok := nodes[rec.ID]
+		if !ok {
+			u = &uptime{id: rec.ID}
+			nodes[rec.ID] = u
+		}
+		if rec.Hostname != "" {
+			u.hostname = rec.Hostname
+		}
+		return u
+	}
+
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		if strings.TrimSpace(sc.Text()) == "" {
+			continue
+		}
+		var rec historyRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		switch rec.Event {
+		case historyStart:
+			// A start without a stop means the previous observer crashed;
+			// its last record is the best guess for when.
+			if observer {
+				closeWindow(last)
+			}
+			observer = true
+		case historyStop:
+			closeWindow(rec.Time)
+		case "joined", "recovered":
+			node(rec).setUp(rec.Time, true)
+		case "restarted":
+			u := node(rec)
+			if u.seen && u.isUp {
+				u.flaps++
+			}
+			u.setUp(rec.Time, true)
+		case "left":
+			node(rec).setUp(rec.Time, false)
+		case "suspect":
+			u := node(rec)
+			u.advance(rec.Time)
+			u.suspects++
+		}
+		last = rec.Time
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if observer {
+		closeWindow(last)
+	}
+
+	stats := make([]*uptime, 0, len(nodes))
+	for _, u := range nodes {
+		stats = append(stats, u)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].id.String() < stats[j].id.String() })
+	return stats, nil
+}
+
+func runReplay(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	stats, err := replayHistory(f)
+	if err != nil {
+		return fmt.Errorf("replay %s: %w", path, err)
+	}
+	fmt.Printf("%-36s  %-16s  %8s  %10s  %5s  %8s  %s\n",
+		"NODE", "HOSTNAME", "AVAIL", "OBSERVED", "FLAPS", "SUSPECTS", "LONGEST OUTAGE")
+	for _, u := range stats {
+		fmt.Printf("%-36s  %-16s  %7.2f%%  %10s  %5d  %8d  %s\n", u.id, u.hostname, u.availability()*100,
+			u.observed.Round(time.Second), u.flaps, u.suspects, u.longestOutage.Round(time.Millisecond))
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"networks_nsu/lab1/discovery"
+)
+
+func TestReplayHistory(t *testing.T) {
+	t0 := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	observer := discovery.NodeID{0: 1}
+	hosts := map[string]discovery.NodeID{"a": {0: 2}, "b": {0: 3}}
+	// rec builds a record s seconds into the log; host is empty for the
+	// observer's own records.
+	rec := func(s int, event, host string) historyRecord {
+		r := historyRecord{Time: t0.Add(time.Duration(s) * time.Second), Event: event, ID: observer}
+		if host != "" {
+			r.ID, r.Hostname = hosts[host], host
+		}
+		return r
+	}
+	type want struct {
+		observed, up, longestOutage time.Duration
+		flaps, suspects             int
+	}
+	for _, tc := range []struct {
+		name    string
+		records []historyRecord
+		want    map[string]want
+	}{
+		{
+			name: "observer crashed without a stop record",
+			records: []historyRecord{
+				rec(0, historyStart, ""),
+				rec(0, "joined", "a"),
+				rec(10, "left", "a"),
+				// Nothing was observed between the crash, taken to be at
+				// the last record, and the restart.
+				rec(100, historyStart, ""),
+				rec(110, "joined", "a"),
+				rec(120, historyStop, ""),
+			},
+			want: map[string]want{
+				"a": {observed: 20 * time.Second, up: 20 * time.Second, flaps: 1},
+			},
+		},
+		{
+			name: "restart counted as a flap",
+			records: []historyRecord{
+				rec(0, historyStart, ""),
+				rec(0, "joined", "a"),
+				rec(30, "restarted", "a"),
+				rec(40, "suspect", "a"),
+				rec(45, "recovered", "a"),
+				rec(60, historyStop, ""),
+			},
+			want: map[string]want{
+				"a": {observed: 60 * time.Second, up: 60 * time.Second, flaps: 1, suspects: 1},
+			},
+		},
+		{
+			name: "outage open at the end of the log",
+			records: []historyRecord{
+				rec(0, historyStart, ""),
+				rec(0, "joined", "a"),
+				rec(5, "joined", "b"),
+				rec(20, "left", "a"),
+				rec(50, "left", "b"),
+			},
+			want: map[string]want{
+				"a": {observed: 50 * time.Second, up: 20 * time.Second, longestOutage: 30 * time.Second, flaps: 1},
+				"b": {observed: 45 * time.Second, up: 45 * time.Second, flaps: 1},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var log strings.Builder
+			enc := json.NewEncoder(&log)
+			for _, r := range tc.records {
+				if err := enc.Encode(r); err != nil {
+					t.Fatal(err)
+				}
+			}
+			stats, err := replayHistory(strings.NewReader(log.String()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(stats) != len(tc.want) {
+				t.Fatalf("stats for %d nodes, want %d", len(stats), len(tc.want))
+			}
+			for _, u := range stats {
+				w, ok := tc.want[u.hostname]
+				if !ok {
+					t.Errorf("unexpected node %s (%q)", u.id, u.hostname)
+					continue
+				}
+				got := want{observed: u.observed, up: u.up, longestOutage: u.longestOutage, flaps: u.flaps, suspects: u.suspects}
+				if got != w {
+					t.Errorf("%s: %+v, want %+v", u.hostname, got, w)
+				}
+			}
+		})
+	}
+}
+
+func TestReplayHistoryMalformed(t *testing.T) {
+	_, err := replayHistory(strings.NewReader("\n{\"event\":\"start\"}\nnot json\n"))
+	if err == nil || !strings.HasPrefix(err.Error(), "line 3:") {
+		t.Errorf("error %v, want one for line 3", err)
+	}
+}
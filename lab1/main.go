@@ -1,176 +1,411 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"os/signal"
 	"sort"
+	"strings"
+	"syscall"
 	"time"
 
-	"golang.org/x/net/ipv6"
+	"networks_nsu/lab1/discovery"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 func main() {
-	groupFlag := flag.String("group", "", "multicast group address with port, e.g. 224.0.0.1:9999 or [ff02::1]:9999")
-	intervalFlag := flag.Duration("interval", 2*time.Second, "heartbeat send interval")
-	timeoutFlag := flag.Duration("timeout", 5*time.Second, "peer disappearence timeout")
+	groupFlag := flag.String("group", "", "comma-separated multicast groups with port, e.g. 224.0.0.1:9999,[ff02::1]:9999")
+	intervalFlag := flag.Duration("interval", discovery.DefaultInterval, "heartbeat send interval")
+	timeoutFlag := flag.Duration("timeout", discovery.DefaultTimeout, "peer disappearence timeout")
+	idFileFlag := flag.String("id-file", discovery.DefaultIDFile(), "file holding the persistent node id, created if missing and locked while running; with the default, more nodes on this host use <file>.2, <file>.3, ...")
+	labelFlag := flag.String("label", "", "optional free-form label sent with heartbeats")
+	detectorFlag := flag.String("detector", string(discovery.DetectorTimeout), "failure detector: timeout (fixed -timeout) or phi (phi-accrual)")
+	phiFlag := flag.Float64("phi-threshold", discovery.DefaultPhiThreshold, "phi level at which a peer is declared dead (-detector=phi)")
+	phiSuspectFlag := flag.Float64("phi-suspect", discovery.DefaultPhiSuspect, "phi level at which a peer is reported suspect (-detector=phi)")
+	phiPauseFlag := flag.Duration("phi-pause", 0, "silence beyond the usual heartbeat interval that raises little suspicion (-detector=phi); 0 means one -interval")
+	keyFileFlag := flag.String("key-file", "", "file with a shared secret; when set heartbeats are signed and unsigned ones rejected")
+	skewFlag := flag.Duration("max-skew", discovery.DefaultMaxSkew, "maximum clock difference accepted for signed heartbeats")
+	electFlag := flag.Bool("elect", false, "take part in electing a leader among peers that also run with -elect")
+	echoFlag := flag.Duration("echo", 0, "interval of unicast echo probes used to measure RTT to peers; 0 disables")
+	httpFlag := flag.String("http", "", "optional address for the JSON status and Prometheus /metrics endpoint, e.g. :8080")
+	ttlFlag := flag.Int("ttl", 0, "multicast TTL / hop limit for heartbeats; 0 keeps the system default (1)")
+	loopbackFlag := flag.Bool("loopback", true, "deliver our heartbeats to other nodes on this host")
+	rescanFlag := flag.Duration("rescan", discovery.DefaultRescan, "how often to look for added or removed interfaces")
+	metaFileFlag := flag.String("meta-file", "", "file with key=value metadata lines to advertise")
+	listFlagOn := flag.Bool("list", false, "query mode: listen for one interval, print peers matching -filter and exit")
+	onceFlag := flag.Bool("once", false, "query mode: collect peers for -wait, print them and exit with status 1 if none were found")
+	waitFlag := flag.Duration("wait", 3*time.Second, "how long -once collects answers")
+	solicitFlag := flag.Bool("solicit", true, "in query modes, ask running nodes to answer immediately")
+	formatFlag := flag.String("format", "text", "query output format: text or json")
+	tuiFlag := flag.Bool("tui", false, "show a continuously refreshing peer table instead of the event log")
+	historyFlag := flag.String("history", "", "append join/leave/suspect events to this JSON Lines file")
+	replayFlag := flag.String("replay", "", "print per-node availability, flaps and longest outage from a -history file and exit")
+	var metaFlag kvFlag
+	filterFlag := kvFlag{allowBare: true}
+	flag.Var(&metaFlag, "meta", "metadata to advertise as key=value, e.g. -meta service=fileserver -meta port=9000 (repeatable)")
+	flag.Var(&filterFlag, "filter", "in query modes, only show peers whose metadata has key=value or just key (repeatable)")
+	var ifaceFlag, excludeFlag, sourceFlag listFlag
+	flag.Var(&sourceFlag, "source", "source address for source-specific joins, e.g. with -group 232.1.1.1:9999 (repeatable)")
+	flag.Var(&ifaceFlag, "iface", "interface names or glob patterns to use (repeatable, comma-separated); default all multicast interfaces")
+	flag.Var(&excludeFlag, "exclude-iface", "interface names or glob patterns to skip, e.g. 'docker*,veth*,tun*'")
 	flag.Parse()
 
+	if *replayFlag != "" {
+		if err := runReplay(*replayFlag); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	if *groupFlag == "" {
 		log.Fatal("Please specify -group, e.g. -group 224.0.0.1:9999")
 	}
 
-	udpAddr, err := net.ResolveUDPAddr("udp", *groupFlag)
+	groups, err := parseGroups(*groupFlag)
 	if err != nil {
-		log.Fatalf("Failed to resolve multicast address %q: %v", *groupFlag, err)
+		log.Fatal(err)
 	}
 
-	var proto string
-	if udpAddr.IP.To4() != nil {
-		proto = "IPv4"
-	} else {
-		proto = "IPv6"
+	var sources []net.IP
+	for _, s := range sourceFlag {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			log.Fatalf("invalid -source %q", s)
+		}
+		sources = append(sources, ip)
 	}
 
-	fmt.Println("Multicast group:", udpAddr.String())
-	fmt.Println("Protocol:", proto)
-	fmt.Println("Heartbeat interval:", *intervalFlag)
-	fmt.Println("Peer timeout:", *timeoutFlag)
-
-	ifaces, err := net.Interfaces()
+	detector, err := discovery.ParseDetector(*detectorFlag)
 	if err != nil {
-		log.Fatalf("net.Interfaces failed: %v", err)
+		log.Fatal(err)
 	}
 
-	var goodIfaces []net.Interface
-	for _, iface := range ifaces {
-		if (iface.Flags&net.FlagUp == 0) || (iface.Flags&net.FlagMulticast == 0) {
-			continue
+	var key []byte
+	if *keyFileFlag != "" {
+		if key, err = discovery.LoadKey(*keyFileFlag); err != nil {
+			log.Fatalf("Failed to load key: %v", err)
 		}
-		goodIfaces = append(goodIfaces, iface)
 	}
 
-	fmt.Println("Will use interfaces:")
-	for _, iface := range goodIfaces {
-		fmt.Println(" ", iface.Name)
+	if *metaFileFlag != "" {
+		// Values given on the command line win over the file.
+		fileMeta := kvFlag{m: make(map[string]string)}
+		if err := loadMetaFile(*metaFileFlag, &fileMeta); err != nil {
+			log.Fatalf("Failed to load metadata: %v", err)
+		}
+		for k, v := range metaFlag.m {
+			fileMeta.m[k] = v
+		}
+		metaFlag = fileMeta
+	}
+
+	// Nodes sharing the default id file on one host each get their own
+	// slot; a file given explicitly belongs to one node only.
+	spill := true
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "id-file" {
+			spill = false
+		}
+	})
+	id, idFile, err := discovery.ClaimNodeID(*idFileFlag, spill)
+	if err != nil {
+		log.Fatalf("Failed to load node id from %q: %v", idFile, err)
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Printf("os.Hostname failed: %v", err)
 	}
 
-	msgCh := make(chan string, 100)
+	d, err := discovery.New(discovery.Config{
+		Groups:            groups,
+		Sources:           sources,
+		Interfaces:        ifaceFlag,
+		ExcludeInterfaces: excludeFlag,
+		RescanInterval:    *rescanFlag,
+		Interval:          *intervalFlag,
+		Timeout:           *timeoutFlag,
+		MulticastTTL:      *ttlFlag,
+		DisableLoopback:   !*loopbackFlag,
+		Detector:          detector,
+		PhiThreshold:      *phiFlag,
+		PhiSuspect:        *phiSuspectFlag,
+		PhiPause:          *phiPauseFlag,
+		EchoInterval:      *echoFlag,
+		Election:          *electFlag,
+		Passive:           *listFlagOn || *onceFlag,
+		Key:               key,
+		MaxClockSkew:      *skewFlag,
+		NodeID:            id,
+		Hostname:          hostname,
+		Label:             *labelFlag,
+		Meta:              metaFlag.m,
+		Registerer:        prometheus.DefaultRegisterer,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	if proto == "IPv4" {
-		for _, ifi := range goodIfaces {
-			conn, err := net.ListenMulticastUDP("udp4", &ifi, udpAddr)
-			if err != nil {
-				log.Println("Join4:", ifi.Name, err)
-				continue
-			}
-			conn.SetReadBuffer(1 << 20)
-			go reader4(conn, msgCh)
+	if *listFlagOn || *onceFlag {
+		wait := *waitFlag
+		if !*onceFlag {
+			wait = d.Config().Interval + d.Config().Interval/4
 		}
-	} else {
-		pc, err := net.ListenPacket("udp6", fmt.Sprintf("[::]:%d", udpAddr.Port))
+		found, err := runQuery(d, wait, *solicitFlag, filterFlag.m, *formatFlag)
 		if err != nil {
-			log.Fatal("listenPacket6: ", err)
+			log.Fatal(err)
 		}
-		p := ipv6.NewPacketConn(pc)
-		for _, ifi := range goodIfaces {
-			if err := p.JoinGroup(&ifi, udpAddr); err != nil {
-				log.Fatal("Join6: ", ifi.Name, err)
-			}
+		if found == 0 {
+			os.Exit(1)
 		}
-		go reader6(pc, msgCh)
+		return
 	}
 
-	go sender(proto, udpAddr, *intervalFlag)
+	cfg := d.Config()
+	fmt.Printf("Node ID: %s (%s)\n", id, idFile)
+	fmt.Println("Multicast groups:")
+	for _, g := range cfg.Groups {
+		proto := "IPv6"
+		if g.IP.To4() != nil {
+			proto = "IPv4"
+		}
+		fmt.Printf("  %s (%s)\n", g, proto)
+	}
+	if len(cfg.Sources) > 0 {
+		fmt.Println("Source-specific multicast from:", sourceFlag.String())
+	}
+	fmt.Println("Heartbeat interval:", cfg.Interval)
+	fmt.Println("Peer timeout:", cfg.Timeout)
+	if cfg.MulticastTTL > 0 {
+		fmt.Println("Multicast TTL:", cfg.MulticastTTL)
+	}
+	if cfg.DisableLoopback {
+		fmt.Println("Multicast loopback: off")
+	}
+	if len(cfg.Key) > 0 {
+		fmt.Println("Authentication: HMAC-SHA256, max clock skew", cfg.MaxClockSkew)
+	}
+	if cfg.Detector == discovery.DetectorPhi {
+		fmt.Printf("Failure detector: phi-accrual, suspect at %.1f, dead at %.1f, acceptable pause %s\n", cfg.PhiSuspect, cfg.PhiThreshold, cfg.PhiPause)
+	}
+	if cfg.Election {
+		fmt.Println("Leader election: lowest id with lease")
+	}
 
-	peers := make(map[string]time.Time)
-	cleanup := time.NewTicker(*timeoutFlag / 2)
-	defer cleanup.Stop()
+	var history *historyLog
+	if *historyFlag != "" {
+		if history, err = openHistory(*historyFlag, id); err != nil {
+			log.Fatalf("Failed to open history: %v", err)
+		}
+		fmt.Println("Peer history:", *historyFlag)
+	}
 
-	for {
-		select {
-		case peerID := <-msgCh:
-			now := time.Now()
-			if _, ex := peers[peerID]; !ex {
-				fmt.Println("New peer live: ", peerID)
-			}
-			peers[peerID] = now
-
-		case <-cleanup.C:
-			now := time.Now()
-			changed := false
-			for peerID, last := range peers {
-				if now.Sub(last) > *timeoutFlag {
-					fmt.Println("Peer died: ", peerID)
-					delete(peers, peerID)
-					changed = true
-				}
-			}
-			if changed {
-				keys := make([]string, 0, len(peers))
-				for k := range peers {
-					keys = append(keys, k)
-				}
-				sort.Strings(keys)
-				fmt.Println("Currently live peers: ")
-				for _, k := range keys {
-					fmt.Println(" ", k)
-				}
+	events, unsubscribe := d.Subscribe()
+	defer unsubscribe()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := d.Start(ctx); err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Println("Will use interfaces:")
+	for _, name := range d.Interfaces() {
+		fmt.Println(" ", name)
+	}
+
+	if *httpFlag != "" {
+		go serveStatus(*httpFlag, d)
+	}
+
+	recordEvent := func(ev discovery.Event) {
+		if history == nil {
+			return
+		}
+		if err := history.record(ev); err != nil {
+			log.Printf("history: %v", err)
+		}
+	}
+	shutdown := func() {
+		fmt.Println("Shutting down, announcing leave to peers")
+		d.Stop()
+		if history != nil {
+			if err := history.Close(id); err != nil {
+				log.Printf("history: %v", err)
 			}
 		}
 	}
-}
 
-func reader4(conn *net.UDPConn, ch chan<- string) {
-	buf := make([]byte, 1500)
+	if *tuiFlag {
+		runTUI(ctx, d, events, recordEvent)
+		shutdown()
+		return
+	}
+
 	for {
-		n, src, err := conn.ReadFromUDP(buf)
-		if err != nil {
-			log.Println("reader4: ", err)
+		select {
+		case <-ctx.Done():
+			shutdown()
 			return
+		case ev := <-events:
+			printEvent(d, ev)
+			recordEvent(ev)
 		}
-		if n > 0 {
-			ch <- src.String()
+	}
+}
+
+func printEvent(d *discovery.Discovery, ev discovery.Event) {
+	switch ev.Type {
+	case discovery.PeerJoined:
+		fmt.Println("New peer live: ", describePeer(ev.Peer))
+	case discovery.PeerRestarted:
+		fmt.Println("Peer restarted: ", describePeer(ev.Peer))
+	case discovery.PeerAddrAdded:
+		fmt.Println("Peer seen on new address: ", ev.Peer.ID, ev.Addr)
+	case discovery.PeerSuspect:
+		fmt.Printf("Peer suspect (phi %.1f): %s\n", ev.Peer.Phi, describePeer(ev.Peer))
+	case discovery.PeerRecovered:
+		fmt.Println("Peer recovered: ", describePeer(ev.Peer))
+	case discovery.PeerLeft:
+		if ev.Reason == discovery.LeaveGoodbye {
+			fmt.Println("Peer left: ", describePeer(ev.Peer))
+		} else {
+			fmt.Println("Peer died: ", describePeer(ev.Peer))
 		}
+		printPeers(d)
+	case discovery.LeaderChanged:
+		fmt.Println(describeLeader(*ev.Leadership))
 	}
 }
 
-func reader6(pc net.PacketConn, ch chan<- string) {
-	buf := make([]byte, 1500)
-	for {
-		n, src, err := pc.ReadFrom(buf)
+func describeLeader(l discovery.Leadership) string {
+	switch {
+	case l.Self:
+		return fmt.Sprintf("Leader: this node (term %d)", l.Term)
+	case l.Leader.IsZero():
+		return fmt.Sprintf("Leader: none, electing (term %d)", l.Term)
+	default:
+		return fmt.Sprintf("Leader: %s (term %d)", l.Leader, l.Term)
+	}
+}
+
+func parseGroups(s string) ([]*net.UDPAddr, error) {
+	var groups []*net.UDPAddr
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		addr, err := net.ResolveUDPAddr("udp", part)
 		if err != nil {
-			log.Println("reader6: ", err)
-			return
+			return nil, fmt.Errorf("failed to resolve multicast address %q: %w", part, err)
 		}
-		if n > 0 {
-			if udp, ok := src.(*net.UDPAddr); ok {
-				ch <- udp.String()
-			}
+		if !addr.IP.IsMulticast() {
+			return nil, fmt.Errorf("%q is not a multicast address", part)
 		}
+		groups = append(groups, addr)
 	}
+	if len(groups) == 0 {
+		return nil, fmt.Errorf("no multicast groups in %q", s)
+	}
+	return groups, nil
 }
 
-func sender(proto string, group *net.UDPAddr, interval time.Duration) {
-	netw := "udp4"
-	if proto == "IPv6" {
-		netw = "udp6"
+func describePeer(p discovery.Peer) string {
+	s := fmt.Sprintf("%s (%s", p.ID, p.Hostname)
+	if p.Label != "" {
+		s += ", " + p.Label
+	}
+	if len(p.Meta) > 0 {
+		s += ", " + formatMeta(p.Meta)
 	}
+	return s + ") via " + strings.Join(p.Addrs, ", ") + " on " + strings.Join(p.Interfaces, ", ")
+}
 
-	conn, err := net.DialUDP(netw, nil, group)
-	if err != nil {
-		log.Fatalf("sender Dial: %v", err)
+func formatMeta(meta map[string]string) string {
+	keys := make([]string, 0, len(meta))
+	for k := range meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = k + "=" + meta[k]
 	}
-	defer conn.Close()
+	return "[" + strings.Join(parts, " ") + "]"
+}
 
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
+// runQuery listens on the groups for wait with the passive d, optionally
+// soliciting immediate answers, prints the peers whose metadata matches
+// filter and returns how many were printed.
+func runQuery(d *discovery.Discovery, wait time.Duration, solicit bool, filter map[string]string, format string) (int, error) {
+	if format != "text" && format != "json" {
+		return 0, fmt.Errorf("unknown format %q, want text or json", format)
+	}
+	if err := d.Start(context.Background()); err != nil {
+		return 0, err
+	}
+	if solicit {
+		d.Solicit()
+	}
+	time.Sleep(wait)
+	all := d.Peers()
+	d.Stop()
 
-	msg := []byte("ping")
-	for range ticker.C {
-		if _, err := conn.Write(msg); err != nil {
-			log.Println("sender write:", err)
+	peers := make([]discovery.Peer, 0, len(all))
+	for _, p := range all {
+		if p.MatchMeta(filter) {
+			peers = append(peers, p)
 		}
 	}
+
+	if format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return len(peers), enc.Encode(peers)
+	}
+	for _, p := range peers {
+		fmt.Println(describePeer(p))
+	}
+	return len(peers), nil
+}
+
+func describeQuality(p discovery.Peer) string {
+	s := fmt.Sprintf("loss %.1f%%, jitter %s", p.Loss*100, p.Jitter.Round(10*time.Microsecond))
+	if p.Suspect {
+		s += fmt.Sprintf(", SUSPECT phi %.1f", p.Phi)
+	}
+	if p.RTT > 0 {
+		s += fmt.Sprintf(", rtt %s", p.RTT.Round(10*time.Microsecond))
+	}
+	return s
+}
+
+func printPeers(d *discovery.Discovery) {
+	fmt.Println("Currently live peers: ")
+	for _, p := range d.Peers() {
+		groups := "groups " + strings.Join(p.Groups, ", ")
+		if len(p.Channels) > 0 {
+			groups = "channels " + strings.Join(p.Channels, ", ")
+		}
+		fmt.Printf("  %s, %s, up %s, seq %d, %s\n", describePeer(p), groups,
+			time.Since(p.Start).Truncate(time.Second), p.Seq, describeQuality(p))
+	}
+	if d.Config().Election {
+		fmt.Println(describeLeader(d.Leader()))
+	}
+	st := d.Stats()
+	fmt.Printf("Ignored datagrams: %d foreign, %d malformed, %d overflow\n", st.Foreign, st.Malformed, st.Overflow)
+	if st.UnlistedSource > 0 {
+		fmt.Printf("Ignored %d datagrams from unlisted sources\n", st.UnlistedSource)
+	}
+	if st.Rejected() > 0 {
+		fmt.Printf("Rejected datagrams: %d unauthenticated, %d replayed, %d stale\n", st.Unauthenticated, st.Replayed, st.Stale)
+	}
 }
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"networks_nsu/lab1/discovery"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func serveStatus(addr string, d *discovery.Discovery) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /peers", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(d.Peers()); err != nil {
+			log.Printf("status: encode peers: %v", err)
+		}
+	})
+	mux.HandleFunc("GET /leader", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(d.Leader()); err != nil {
+			log.Printf("status: encode leader: %v", err)
+		}
+	})
+	mux.HandleFunc("GET /events", func(w http.ResponseWriter, r *http.Request) {
+		streamEvents(w, r, d)
+	})
+	mux.Handle("GET /metrics", promhttp.Handler())
+
+	log.Printf("status endpoint listening on %s (/peers, /leader, /events, /metrics)", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Fatalf("status HTTP server failed: %v", err)
+	}
+}
+
+// streamEvents relays peer events to the client as Server-Sent Events until
+// the client disconnects or discovery stops.
+func streamEvents(w http.ResponseWriter, r *http.Request, d *discovery.Discovery) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	events, unsubscribe := d.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				log.Printf("status: encode event: %v", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"networks_nsu/lab1/discovery"
+
+	"golang.org/x/term"
+)
+
+const (
+	ansiReset   = "\x1b[0m"
+	ansiBold    = "\x1b[1m"
+	ansiReverse = "\x1b[7m"
+	ansiRed     = "\x1b[31m"
+	ansiYellow  = "\x1b[33m"
+)
+
+type sortKey byte
+
+const (
+	sortID       sortKey = 'i'
+	sortAddr     sortKey = 'a'
+	sortIface    sortKey = 'n'
+	sortLastSeen sortKey = 's'
+	sortLoss     sortKey = 'l'
+	sortRTT      sortKey = 'r'
+)
+
+var sortNames = map[sortKey]string{
+	sortID:       "id",
+	sortAddr:     "address",
+	sortIface:    "interface",
+	sortLastSeen: "last seen",
+	sortLoss:     "loss",
+	sortRTT:      "rtt",
+}
+
+func comparePeers(key sortKey, a, b discovery.Peer) int {
+	var c int
+	switch key {
+	case sortAddr:
+		c = cmp.Compare(strings.Join(a.Addrs, ","), strings.Join(b.Addrs, ","))
+	case sortIface:
+		c = cmp.Compare(strings.Join(a.Interfaces, ","), strings.Join(b.Interfaces, ","))
+	case sortLastSeen:
+		// Most recently seen first.
+		c = b.LastSeen.Compare(a.LastSeen)
+	case sortLoss:
+		c = cmp.Compare(a.Loss, b.Loss)
+	case sortRTT:
+		c = cmp.Compare(a.RTT, b.RTT)
+	}
+	if c == 0 {
+		c = cmp.Compare(a.ID.String(), b.ID.String())
+	}
+	return c
+}
+
+// lastLine keeps the most recent log message so it can be shown in the
+// status line instead of scribbling over the table.
+type lastLine struct {
+	mu   sync.Mutex
+	line string
+}
+
+func (l *lastLine) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	l.line = string(bytes.TrimSpace(p))
+	l.mu.Unlock()
+	return len(p), nil
+}
+
+func (l *lastLine) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.line
+}
+
+// runTUI draws the live peer table until ctx is done or the user quits. The
+// table is redrawn on every event, on key presses and once a second so the
+// ages stay current. handle is called for every event, before the redraw.
+func runTUI(ctx context.Context, d *discovery.Discovery, events <-chan discovery.Event, handle func(discovery.Event)) {
+	fd := int(os.Stdin.Fd())
+	keys := make(chan byte)
+	if term.IsTerminal(fd) {
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			log.Printf("tui: %v", err)
+		} else {
+			defer term.Restore(fd, state)
+			go readKeys(keys)
+		}
+	}
+
+	logs := &lastLine{}
+	log.SetOutput(logs)
+	defer log.SetOutput(os.Stderr)
+
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	defer fmt.Print("\x1b[?25h\x1b[?1049l")
+
+	key, reverse := sortID, false
+	var last string
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		last = drawTable(d, key, reverse, last, logs.String())
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-events:
+			handle(ev)
+		case <-tick.C:
+		case k := <-keys:
+			switch k := sortKey(k); {
+			case k == 'q' || k == 3: // Ctrl-C does not raise SIGINT in raw mode.
+				return
+			case k == key:
+				reverse = !reverse
+			case sortNames[k] != "":
+				key, reverse = k, false
+			}
+		}
+	}
+}
+
+func readKeys(keys chan<- byte) {
+	buf := make([]byte, 1)
+	for {
+		if n, err := os.Stdin.Read(buf); err != nil || n == 0 {
+			return
+		}
+		keys <- buf[0]
+	}
+}
+
+// truncate cuts s to width columns, taking each rune as one column as the
+// padding of the table does, so that a multi-byte hostname or label is
+// never split inside a character.
+func truncate(s string, width int) string {
+	n := 0
+	for i := range s {
+		if n == width {
+			return s[:i]
+		}
+		n++
+	}
+	return s
+}
+
+// drawTable renders the table and writes it out unless it is identical to
+// prev, returning what was drawn.
+func drawTable(d *discovery.Discovery, key sortKey, reverse bool, prev, status string) string {
+	width, height, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		width, height = 120, 40
+	}
+
+	peers := d.Peers()
+	slices.SortFunc(peers, func(a, b discovery.Peer) int {
+		if reverse {
+			return comparePeers(key, b, a)
+		}
+		return comparePeers(key, a, b)
+	})
+
+	var b strings.Builder
+	line := func(style, s string) {
+		b.WriteString(style + truncate(s, width) + ansiReset + "\x1b[K\r\n")
+	}
+
+	order := "ascending"
+	if reverse {
+		order = "descending"
+	}
+	line(ansiBold, fmt.Sprintf("%s  %d peers  sorted by %s (%s)", d.ID(), len(peers), sortNames[key], order))
+	if d.Config().Election {
+		line(ansiBold, describeLeader(d.Leader()))
+	}
+	line("", "keys: i id  a address  n interface  s last seen  l loss  r rtt  (again to reverse)  q quit")
+	line(ansiReverse, fmt.Sprintf("%-36s  %-40s  %-10s  %9s  %7s  %9s  %s",
+		"ID", "ADDRESSES", "INTERFACE", "LAST SEEN", "LOSS", "RTT", "STATE"))
+
+	now := time.Now()
+	rows := height - 6
+	for i, p := range peers {
+		if i == rows {
+			line("", fmt.Sprintf("... %d more", len(peers)-rows))
+			break
+		}
+		style, state := "", "ok"
+		if p.Leader {
+			state = "LEADER"
+		}
+		switch {
+		case p.Suspect:
+			style, state = ansiRed, fmt.Sprintf("SUSPECT phi %.1f", p.Phi)
+		case p.Loss > 0:
+			style = ansiYellow
+		}
+		rtt := "-"
+		if p.RTT > 0 {
+			rtt = p.RTT.Round(10 * time.Microsecond).String()
+		}
+		line(style, fmt.Sprintf("%-36s  %-40s  %-10s  %9s  %6.1f%%  %9s  %s",
+			p.ID, strings.Join(p.Addrs, ","), strings.Join(p.Interfaces, ","),
+			now.Sub(p.LastSeen).Truncate(100*time.Millisecond), p.Loss*100, rtt, state))
+	}
+	b.WriteString("\x1b[J")
+	if status != "" {
+		fmt.Fprintf(&b, "\x1b[%d;1H%s%s%s", height, ansiBold, truncate(status, width), ansiReset)
+	}
+
+	frame := b.String()
+	if frame != prev {
+		fmt.Print("\x1b[H" + frame)
+	}
+	return frame
+}
@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestTruncate(t *testing.T) {
+	for _, tc := range []struct {
+		s     string
+		width int
+		want  string
+	}{
+		{"node-1", 10, "node-1"},
+		{"node-1", 6, "node-1"},
+		{"node-1", 4, "node"},
+		{"узел-1", 4, "узел"},
+		{"ノード", 2, "ノー"},
+		{"x", 0, ""},
+	} {
+		if got := truncate(tc.s, tc.width); got != tc.want {
+			t.Errorf("truncate(%q, %d) = %q, want %q", tc.s, tc.width, got, tc.want)
+		}
+	}
+}
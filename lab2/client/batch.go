@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"networks_nsu/lab2/protocol"
+)
+
+type localEntry struct {
+	protocol.Entry
+	src string
+}
+
+// collect lists the files to send. A directory is sent with everything
+// below it, under its own name, like cp -r; symlinks and other special
+// files inside it are skipped.
+func collect(paths []string) ([]localEntry, error) {
+	var entries []localEntry
+	add := func(name, src string, fi fs.FileInfo) error {
+		if len(name) > protocol.MaxNameLen {
+			return fmt.Errorf("path too long: %d bytes", len(name))
+		}
+		mode, err := protocol.EntryMode(fi.Mode())
+		if err != nil {
+			return fmt.Errorf("%s: %w", src, err)
+		}
+		e := localEntry{Entry: protocol.Entry{Path: name, Mode: mode, MTime: fi.ModTime()}, src: src}
+		if !fi.IsDir() {
+			e.Size = uint64(fi.Size())
+		}
+		entries = append(entries, e)
+		return nil
+	}
+
+	for _, p := range paths {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return nil, err
+		}
+		fi, err := os.Stat(abs)
+		if err != nil {
+			return nil, err
+		}
+		base := filepath.Base(abs)
+		if base == string(filepath.Separator) {
+			return nil, errors.New("cannot send the root directory")
+		}
+		if !fi.IsDir() {
+			if err := add(base, abs, fi); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		err = filepath.WalkDir(abs, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.IsDir() && !d.Type().IsRegular() {
+				log.Printf("skipping %s: %s", p, d.Type())
+				return nil
+			}
+			rel, err := filepath.Rel(abs, p)
+			if err != nil {
+				return err
+			}
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			return add(path.Join(base, filepath.ToSlash(rel)), p, fi)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// put sends paths as one batch, reconnecting after a broken connection to
+// go on with the entry it interrupted, and returns the exit code.
+func put(paths []string, hashAlg protocol.HashAlg) int {
+	entries, err := collect(paths)
+	if err != nil {
+		log.Fatal(err)
+	}
+	statuses := make([]byte, len(entries))
+	next := 0
+	for attempt := 0; ; attempt++ {
+		next, err = sendEntries(entries, next, hashAlg, statuses)
+		if err == nil {
+			break
+		}
+		if errors.Is(err, errOldServer) {
+			if len(entries) == 1 && !entries[0].IsDir() {
+				log.Printf("%v, falling back to a plain upload", err)
+				return putFile(entries[0].src, hashAlg)
+			}
+			log.Printf("%v, falling back to a batch upload", err)
+			attempt--
+			continue
+		}
+		if attempt == *retries {
+			log.Fatalf("upload failed: %v", err)
+		}
+		log.Printf("upload interrupted: %v; retrying in %s", err, *retryDelay)
+		time.Sleep(*retryDelay)
+	}
+
+	ok := 0
+	for _, s := range statuses {
+		if s == protocol.StatusOK {
+			ok++
+		}
+	}
+	fmt.Printf("Transferred %d of %d entries\n", ok, len(entries))
+	if ok != len(entries) {
+		return 1
+	}
+	return 0
+}
+
+// sendEntries sends entries[from:] over a new connection, recording the
+// server's answer to each in statuses. It returns how far it got.
+func sendEntries(entries []localEntry, from int, hashAlg protocol.HashAlg, statuses []byte) (int, error) {
+	conn, w, err := openPut(hashAlg)
+	if err != nil {
+		return from, err
+	}
+	defer conn.Close()
+
+	for i := from; i < len(entries); i++ {
+		e := entries[i]
+		var f *os.File
+		if !e.IsDir() {
+			if f, err = os.Open(e.src); err != nil {
+				log.Printf("cannot open file %q: %v", e.src, err)
+				statuses[i] = protocol.StatusFailed
+				report(e.Path, statuses[i])
+				continue
+			}
+		}
+		status, stored, err := sendEntry(conn, w, e, f, hashAlg)
+		if f != nil {
+			f.Close()
+		}
+		if err != nil {
+			return i, err
+		}
+		statuses[i] = status
+		if stored != "" && stored != e.Path {
+			report(e.Path+" -> "+stored, status)
+		} else {
+			report(e.Path, status)
+		}
+	}
+
+	if err := protocol.WriteEnd(w); err != nil {
+		return len(entries), fmt.Errorf("write end of batch failed: %w", err)
+	}
+	if err := w.Flush(); err != nil {
+		return len(entries), fmt.Errorf("flush failed: %w", err)
+	}
+	return len(entries), nil
+}
+
+// openPut starts a batch upload, as a put request or, once the server
+// turned out not to support requests, with the VersionBatch header.
+func openPut(hashAlg protocol.HashAlg) (net.Conn, *bufio.Writer, error) {
+	if negotiated == 0 || negotiated >= protocol.VersionOps {
+		return openSession(protocol.Request{Op: protocol.OpPut, HashAlg: hashAlg})
+	}
+	conn, err := dial()
+	if err != nil {
+		return nil, nil, fmt.Errorf("dial failed: %w", err)
+	}
+	logConnected(conn)
+	w := bufio.NewWriter(conn)
+	hdr := protocol.UploadHeader{Version: protocol.VersionBatch, ClientID: *clientID, HashAlg: hashAlg}
+	if err := hdr.Write(w); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("write header failed: %w", err)
+	}
+	return conn, w, nil
+}
+
+// sendEntry announces e and, if the server accepts it, sends the file f.
+// It returns the entry's status and, if the server tells, the name it was
+// stored under.
+func sendEntry(conn net.Conn, w *bufio.Writer, e localEntry, f *os.File, hashAlg protocol.HashAlg) (byte, string, error) {
+	if err := e.Write(w); err != nil {
+		return 0, "", fmt.Errorf("write entry failed: %w", err)
+	}
+	if err := w.Flush(); err != nil {
+		return 0, "", fmt.Errorf("flush entry failed: %w", err)
+	}
+	status, err := readStatus(conn)
+	if err == nil && !e.IsDir() && status == protocol.StatusOK {
+		status, err = sendBody(conn, w, f, protocol.UploadHeader{Name: e.Path, Size: e.Size, HashAlg: hashAlg})
+	}
+	if err != nil || negotiated < protocol.VersionNames {
+		return status, "", err
+	}
+	conn.SetReadDeadline(time.Now().Add(*timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	stored, err := protocol.ReadName(conn)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to read stored name: %w", err)
+	}
+	return status, stored, nil
+}
+
+func report(path string, status byte) {
+	fmt.Printf("%-17s %s\n", statusText(status), path)
+}
+
+func statusText(status byte) string {
+	switch status {
+	case protocol.StatusOK:
+		return "ok"
+	case protocol.StatusChecksumMismatch:
+		return "checksum mismatch"
+	case protocol.StatusRejected:
+		return "rejected"
+	case protocol.StatusNotFound:
+		return "not found"
+	case protocol.StatusExists:
+		return "exists"
+	default:
+		return "failed"
+	}
+}
@@ -2,33 +2,108 @@ package main
 
 import (
 	"bufio"
-	"encoding/binary"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
+	"path"
 	"path/filepath"
 	"time"
+
+	"networks_nsu/lab2/protocol"
 )
 
 var (
 	serverAddr = flag.String("addr", "localhost:9000", "server address host:port")
-	filePath   = flag.String("file", "", "path to the file to send")
+	filePath   = flag.String("file", "", "path to the file to send; more files and directories may follow as arguments")
 	timeout    = flag.Duration("timeout", 10*time.Second, "connection timeout")
+	clientID   = flag.String("id", defaultClientID(), "client id under which the server keeps partial uploads for resuming")
+	retries    = flag.Int("retries", 3, "how many times to reconnect and resume after a broken connection")
+	retryDelay = flag.Duration("retry-delay", 2*time.Second, "pause before reconnecting")
+	hashFlag   = flag.String("hash", "sha256", "checksum the server verifies the upload against: sha256, xxhash or none")
+	useTLS     = flag.Bool("tls", false, "connect over TLS; implied by -ca and -cert")
+	caFile     = flag.String("ca", "", "PEM CA bundle to verify the server with instead of the system roots")
+	certFile   = flag.String("cert", "", "PEM client certificate for servers that require mutual TLS")
+	keyFile    = flag.String("key", "", "PEM private key of -cert")
 )
 
+// tlsConfig is nil for plain TCP.
+var tlsConfig *tls.Config
+
+func defaultClientID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		return "client"
+	}
+	return host
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "usage: %s [flags] command\n\n", os.Args[0])
+	fmt.Fprintf(out, "  put path...          upload files and directories\n")
+	fmt.Fprintf(out, "  get remote [local]   download a stored file\n")
+	fmt.Fprintf(out, "  ls [path]            list stored files\n")
+	fmt.Fprintf(out, "  rm path...           delete stored files or empty directories\n\n")
+	fmt.Fprintf(out, "-file path is short for put path.\n\nflags:\n")
+	flag.PrintDefaults()
+}
+
 func main() {
+	flag.Usage = usage
 	flag.Parse()
 
-	if *filePath == "" {
-		log.Fatalf("please specify -file")
+	hashAlg, err := protocol.ParseHashAlg(*hashFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *useTLS || *caFile != "" || *certFile != "" {
+		if tlsConfig, err = clientTLSConfig(*serverAddr, *caFile, *certFile, *keyFile); err != nil {
+			log.Fatalf("TLS setup failed: %v", err)
+		}
+	}
+
+	if *filePath != "" {
+		os.Exit(put(append([]string{*filePath}, flag.Args()...), hashAlg))
+	}
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, args := args[0], args[1:]
+	switch {
+	case cmd == "put" && len(args) > 0:
+		os.Exit(put(args, hashAlg))
+	case cmd == "get" && (len(args) == 1 || len(args) == 2):
+		local := path.Base(args[0])
+		if len(args) == 2 {
+			local = args[1]
+		}
+		os.Exit(get(args[0], local, hashAlg))
+	case cmd == "ls" && len(args) <= 1:
+		var dir string
+		if len(args) == 1 {
+			dir = args[0]
+		}
+		os.Exit(ls(dir))
+	case cmd == "rm" && len(args) > 0:
+		os.Exit(rm(args))
+	default:
+		usage()
+		os.Exit(2)
 	}
+}
 
-	f, err := os.Open(*filePath)
+// putFile uploads a single file with the framing that predates batches,
+// for servers that know nothing newer.
+func putFile(file string, hashAlg protocol.HashAlg) int {
+	f, err := os.Open(file)
 	if err != nil {
-		log.Fatalf("cannot open file %q: %v", *filePath, err)
+		log.Fatalf("cannot open file %q: %v", file, err)
 	}
 	defer f.Close()
 
@@ -36,70 +111,143 @@ func main() {
 	if err != nil {
 		log.Fatalf("stat failed: %v", err)
 	}
-	if fi.IsDir() {
-		log.Fatalf("%q is a directory", *filePath)
+	fileSize := uint64(fi.Size())
+	filename := filepath.Base(file)
+	if len(filename) > protocol.MaxNameLen {
+		log.Fatalf("filename too long: %d bytes", len(filename))
+	}
+	hdr := protocol.UploadHeader{
+		Version:  protocol.VersionChecksum,
+		ClientID: *clientID,
+		Name:     filename,
+		Size:     fileSize,
+		HashAlg:  hashAlg,
+	}
+
+	for attempt := 0; ; attempt++ {
+		status, err := upload(f, hdr)
+		if err == nil {
+			switch status {
+			case protocol.StatusOK:
+				fmt.Println("File transfer successful")
+				return 0
+			case protocol.StatusChecksumMismatch:
+				fmt.Println("File transfer failed: checksum mismatch, the server discarded the file")
+			case protocol.StatusExists:
+				fmt.Println("File transfer failed: the name is taken on the server")
+			default:
+				fmt.Println("File transfer failed")
+			}
+			return 1
+		}
+		if attempt == *retries {
+			log.Fatalf("upload failed: %v", err)
+		}
+		log.Printf("upload interrupted: %v; retrying in %s", err, *retryDelay)
+		time.Sleep(*retryDelay)
 	}
+}
 
-	fileSize := uint64(fi.Size())
-	filename := filepath.Base(*filePath)
-	nameBytes := []byte(filename)
-	if len(nameBytes) > 0xFFFF {
-		log.Fatalf("filename too long: %d bytes", len(nameBytes))
+func dial() (net.Conn, error) {
+	d := &net.Dialer{Timeout: *timeout}
+	if tlsConfig == nil {
+		return d.Dial("tcp", *serverAddr)
 	}
-	nameLen := uint16(len(nameBytes))
+	return tls.DialWithDialer(d, "tcp", *serverAddr, tlsConfig)
+}
 
-	conn, err := net.DialTimeout("tcp", *serverAddr, *timeout)
+// upload sends the part of the file the server does not have yet and
+// returns the server's status. An error means the connection broke and the
+// upload can be resumed.
+func upload(f *os.File, hdr protocol.UploadHeader) (byte, error) {
+	conn, err := dial()
 	if err != nil {
-		log.Fatalf("dial failed: %v", err)
+		return 0, fmt.Errorf("dial failed: %w", err)
 	}
 	defer conn.Close()
-	log.Printf("connected to %s", *serverAddr)
+	logConnected(conn)
 
 	w := bufio.NewWriter(conn)
-
-	if err := binary.Write(w, binary.BigEndian, nameLen); err != nil {
-		log.Fatalf("write name length failed: %v", err)
+	if err := hdr.Write(w); err != nil {
+		return 0, fmt.Errorf("write header failed: %w", err)
 	}
-
-	if _, err := w.Write(nameBytes); err != nil {
-		log.Fatalf("write filename failed: %v", err)
+	if err := w.Flush(); err != nil {
+		return 0, fmt.Errorf("flush header failed: %w", err)
 	}
+	return sendBody(conn, w, f, hdr)
+}
 
-	if err := binary.Write(w, binary.BigEndian, fileSize); err != nil {
-		log.Fatalf("write file size failed: %v", err)
+func logConnected(conn net.Conn) {
+	if tc, ok := conn.(*tls.Conn); ok {
+		st := tc.ConnectionState()
+		log.Printf("connected to %s over %s (%s)", *serverAddr, tls.VersionName(st.Version), st.PeerCertificates[0].Subject)
+	} else {
+		log.Printf("connected to %s", *serverAddr)
 	}
+}
 
-	if err := w.Flush(); err != nil {
-		log.Fatalf("flush header failed: %v", err)
+// sendBody reads the resume offset, sends the rest of f and the checksum
+// trailer, and returns the server's status; hdr names the file, its size
+// and hash algorithm.
+func sendBody(conn net.Conn, w *bufio.Writer, f *os.File, hdr protocol.UploadHeader) (byte, error) {
+	conn.SetReadDeadline(time.Now().Add(*timeout))
+	offset, err := protocol.ReadOffset(conn)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read resume offset: %w", err)
+	}
+	conn.SetReadDeadline(time.Time{})
+	if offset > hdr.Size {
+		return 0, fmt.Errorf("server claims %d of %d bytes", offset, hdr.Size)
+	}
+	if offset > 0 {
+		log.Printf("server already has %d of %d bytes of %q, resuming", offset, hdr.Size, hdr.Name)
+	}
+	// The checksum covers the whole file, including what the server
+	// already has.
+	var body io.Reader = f
+	h := hdr.HashAlg.New()
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		log.Fatalf("seek failed: %v", err)
+	}
+	if h != nil {
+		if _, err := io.CopyN(h, f, int64(offset)); err != nil {
+			log.Fatalf("hashing %q failed: %v", hdr.Name, err)
+		}
+		body = io.TeeReader(f, h)
+	} else if _, err := f.Seek(int64(offset), io.SeekStart); err != nil {
+		log.Fatalf("seek failed: %v", err)
 	}
 
-	sent, err := io.Copy(w, f)
+	// Never send more than announced, the file may have grown since.
+	sent, err := io.Copy(w, io.LimitReader(body, int64(hdr.Size-offset)))
 	if err != nil {
-		log.Fatalf("sending file content failed after %d bytes: %v", sent, err)
+		return 0, fmt.Errorf("sending file content failed after %d bytes: %w", offset+uint64(sent), err)
 	}
-	if uint64(sent) != fileSize {
-		log.Fatalf("sent bytes mismatch: expected %d, got %d", fileSize, sent)
+	if offset+uint64(sent) != hdr.Size {
+		log.Fatalf("sent bytes mismatch: expected %d, got %d", hdr.Size, offset+uint64(sent))
 	}
 
+	if h != nil {
+		sum := h.Sum(nil)
+		log.Printf("%s %x %s", hdr.HashAlg, sum, hdr.Name)
+		if err := protocol.WriteTrailer(w, sum); err != nil {
+			return 0, fmt.Errorf("write checksum failed: %w", err)
+		}
+	}
 	if err := w.Flush(); err != nil {
-		log.Fatalf("flush body failed: %v", err)
+		return 0, fmt.Errorf("flush body failed: %w", err)
 	}
 
-	log.Printf("sent %q (%d bytes) successfully, waiting for server response...", filename, fileSize)
+	log.Printf("sent %q (%d bytes) successfully, waiting for server response...", hdr.Name, hdr.Size)
 
 	resp := make([]byte, 1)
 	conn.SetReadDeadline(time.Now().Add(*timeout))
 	n, err := conn.Read(resp)
 	if err != nil {
-		log.Fatalf("failed to read response from server: %v", err)
+		return 0, fmt.Errorf("failed to read response from server: %w", err)
 	}
 	if n != 1 {
 		log.Fatalf("unexpected response length: %d", n)
 	}
-
-	if resp[0] == 1 {
-		fmt.Println("File transfer successful")
-	} else {
-		fmt.Println("File transfer failed")
-	}
+	return resp[0], nil
 }
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"networks_nsu/lab2/protocol"
+)
+
+// set changes a flag or other global for the rest of the test.
+func set[T any](t *testing.T, p *T, v T) {
+	t.Helper()
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+// fakeServer points the client at a local listener whose connections are
+// handled one after another by handle.
+func fakeServer(t *testing.T, handle func(conn net.Conn, r *bufio.Reader)) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	set(t, serverAddr, ln.Addr().String())
+	set(t, clientID, "test")
+	set(t, retryDelay, 0)
+	set(t, &tlsConfig, nil)
+	set(t, &negotiated, 0)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.SetDeadline(time.Now().Add(10 * time.Second))
+			handle(conn, bufio.NewReader(conn))
+			conn.Close()
+		}
+	}()
+}
+
+func writeTemp(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(p, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// receive reads the rest of a single-file upload after the server has
+// got held bytes of it, checks the SHA-256 trailer and answers like the
+// real server. It returns the whole file.
+func receive(t *testing.T, conn net.Conn, r *bufio.Reader, hdr protocol.UploadHeader, held []byte) []byte {
+	rest := make([]byte, hdr.Size-uint64(len(held)))
+	if _, err := io.ReadFull(r, rest); err != nil {
+		t.Errorf("read body: %v", err)
+		return nil
+	}
+	data := append(held, rest...)
+	sum, err := protocol.ReadTrailer(r)
+	if err != nil {
+		t.Errorf("read trailer: %v", err)
+		return nil
+	}
+	status := protocol.StatusOK
+	if want := sha256.Sum256(data); !bytes.Equal(sum, want[:]) {
+		status = protocol.StatusChecksumMismatch
+	}
+	conn.Write([]byte{status})
+	return data
+}
+
+// TestPutFileResumes breaks the first connection in the middle of the body
+// and checks that the client reconnects and sends only what the server
+// reports missing, with a checksum over the whole file.
+func TestPutFileResumes(t *testing.T) {
+	data := bytes.Repeat([]byte("resumable contents "), 10000)
+	file := writeTemp(t, "big.txt", data)
+	done := make(chan []byte, 1)
+	var held []byte
+	var conns int
+	fakeServer(t, func(conn net.Conn, r *bufio.Reader) {
+		conns++
+		hdr, err := protocol.ReadUploadHeader(r)
+		if err != nil || hdr.Version != protocol.VersionChecksum || hdr.ClientID != "test" ||
+			hdr.Name != "big.txt" || hdr.Size != uint64(len(data)) || hdr.HashAlg != protocol.HashSHA256 {
+			t.Errorf("header %+v, %v", hdr, err)
+			return
+		}
+		if err := protocol.WriteOffset(conn, uint64(len(held))); err != nil {
+			t.Error(err)
+			return
+		}
+		if conns == 1 {
+			buf := make([]byte, 1000)
+			n, _ := io.ReadFull(r, buf)
+			held = append(held, buf[:n]...)
+			return
+		}
+		done <- receive(t, conn, r, hdr, held)
+	})
+
+	if code := putFile(file, protocol.HashSHA256); code != 0 {
+		t.Fatalf("putFile = %d", code)
+	}
+	if got := <-done; !bytes.Equal(got, data) {
+		t.Errorf("server got %d bytes, want %d", len(got), len(data))
+	}
+	if len(held) != 1000 {
+		t.Errorf("first connection delivered %d bytes", len(held))
+	}
+}
+
+func TestUploadRejectsBadOffset(t *testing.T) {
+	fakeServer(t, func(conn net.Conn, r *bufio.Reader) {
+		if _, err := protocol.ReadUploadHeader(r); err != nil {
+			t.Error(err)
+			return
+		}
+		protocol.WriteOffset(conn, 1<<20)
+	})
+	f, err := os.Open(writeTemp(t, "small.txt", []byte("small")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	hdr := protocol.UploadHeader{Version: protocol.VersionChecksum, ClientID: "test", Name: "small.txt", Size: 5}
+	if _, err := upload(f, hdr); err == nil {
+		t.Error("upload went on past a resume offset beyond the end of the file")
+	}
+}
+
+// TestPutFallsBackToPlainUpload talks to a server that predates requests
+// and batches: it drops the connection on the hello, and the client must
+// send a single file with the plain upload header instead.
+func TestPutFallsBackToPlainUpload(t *testing.T) {
+	data := []byte("for an old server")
+	file := writeTemp(t, "old.txt", data)
+	done := make(chan []byte, 1)
+	var versions []uint8
+	fakeServer(t, func(conn net.Conn, r *bufio.Reader) {
+		hdr, err := protocol.ReadUploadHeader(r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		versions = append(versions, hdr.Version)
+		if hdr.Version > protocol.VersionChecksum {
+			return
+		}
+		if err := protocol.WriteOffset(conn, 0); err != nil {
+			t.Error(err)
+			return
+		}
+		done <- receive(t, conn, r, hdr, nil)
+	})
+
+	if code := put([]string{file}, protocol.HashSHA256); code != 0 {
+		t.Fatalf("put = %d", code)
+	}
+	if got := <-done; !bytes.Equal(got, data) {
+		t.Errorf("server got %q", got)
+	}
+	if len(versions) != 2 || versions[0] != protocol.VersionNames || versions[1] != protocol.VersionChecksum {
+		t.Errorf("headers of versions %v, want a hello then a plain upload", versions)
+	}
+	if negotiated != protocol.VersionBatch {
+		t.Errorf("negotiated %d, want %d", negotiated, protocol.VersionBatch)
+	}
+}
+
+// TestOpenSessionNegotiates checks that the client takes the version the
+// server talks down to and reads stored names only when it has them.
+func TestOpenSessionNegotiates(t *testing.T) {
+	fakeServer(t, func(conn net.Conn, r *bufio.Reader) {
+		hdr, err := protocol.ReadUploadHeader(r)
+		if err != nil || hdr.Version != protocol.VersionNames {
+			t.Errorf("hello %+v, %v", hdr, err)
+			return
+		}
+		protocol.WriteVersion(conn, protocol.VersionOps)
+		q, err := protocol.ReadRequest(r)
+		if err != nil || q.Op != protocol.OpList {
+			t.Errorf("request %+v, %v", q, err)
+		}
+	})
+	conn, _, err := openSession(protocol.Request{Op: protocol.OpList})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if negotiated != protocol.VersionOps {
+		t.Errorf("negotiated %d, want %d", negotiated, protocol.VersionOps)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"networks_nsu/lab2/protocol"
+)
+
+var errOldServer = errors.New("server does not support requests")
+
+// negotiated is the protocol version the server agreed to, 0 until the
+// first connection.
+var negotiated uint8
+
+// openSession says hello, negotiates the version and sends q. A server
+// that predates requests drops the connection on the hello; put then
+// assumes it still takes batches.
+func openSession(q protocol.Request) (net.Conn, *bufio.Writer, error) {
+	conn, err := dial()
+	if err != nil {
+		return nil, nil, fmt.Errorf("dial failed: %w", err)
+	}
+	logConnected(conn)
+
+	w := bufio.NewWriter(conn)
+	hdr := protocol.UploadHeader{Version: protocol.VersionNames, ClientID: *clientID}
+	if err := hdr.Write(w); err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("write header failed: %w", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(*timeout))
+	v, err := protocol.ReadVersion(conn)
+	if err == nil && v < protocol.VersionOps {
+		err = io.EOF
+	}
+	if err != nil {
+		conn.Close()
+		if errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET) {
+			negotiated = protocol.VersionBatch
+			return nil, nil, errOldServer
+		}
+		return nil, nil, fmt.Errorf("failed to read protocol version: %w", err)
+	}
+	conn.SetReadDeadline(time.Time{})
+	negotiated = v
+
+	if err := q.Write(w); err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("write request failed: %w", err)
+	}
+	return conn, w, nil
+}
+
+func readStatus(conn net.Conn) (byte, error) {
+	conn.SetReadDeadline(time.Now().Add(*timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	var b [1]byte
+	if _, err := io.ReadFull(conn, b[:]); err != nil {
+		return 0, fmt.Errorf("failed to read response from server: %w", err)
+	}
+	return b[0], nil
+}
+
+// request opens a session for q and returns the connection once the server
+// has answered with StatusOK.
+func request(q protocol.Request) (net.Conn, byte) {
+	conn, _, err := openSession(q)
+	if err != nil {
+		log.Fatalf("%s failed: %v", q.Op, err)
+	}
+	status, err := readStatus(conn)
+	if err != nil {
+		log.Fatalf("%s failed: %v", q.Op, err)
+	}
+	if status != protocol.StatusOK {
+		conn.Close()
+		return nil, status
+	}
+	return conn, status
+}
+
+// get downloads remote into local through a temporary file that only
+// replaces local once the checksum matched.
+func get(remote, local string, hashAlg protocol.HashAlg) int {
+	conn, status := request(protocol.Request{Op: protocol.OpGet, Path: remote, HashAlg: hashAlg})
+	if conn == nil {
+		report(remote, status)
+		return 1
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	e, err := protocol.ReadEntry(r)
+	if err != nil {
+		log.Fatalf("get failed: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(local), "."+filepath.Base(local)+".*")
+	if err != nil {
+		log.Fatalf("cannot create %q: %v", local, err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	var dst io.Writer = tmp
+	h := hashAlg.New()
+	if h != nil {
+		dst = io.MultiWriter(tmp, h)
+	}
+	if _, err := io.CopyN(dst, r, int64(e.Size)); err != nil {
+		log.Fatalf("download of %q interrupted: %v", remote, err)
+	}
+	want, err := protocol.ReadTrailer(r)
+	if err != nil {
+		log.Fatalf("failed to read checksum: %v", err)
+	}
+	if h != nil {
+		sum := h.Sum(nil)
+		if !bytes.Equal(want, sum) {
+			log.Printf("%s mismatch for %q: server %x, received %x", hashAlg, remote, want, sum)
+			report(remote, protocol.StatusChecksumMismatch)
+			return 1
+		}
+		log.Printf("%s %x %s", hashAlg, sum, local)
+	}
+
+	if err := tmp.Chmod(e.Perm()); err != nil {
+		log.Fatalf("chmod %q: %v", tmp.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		log.Fatalf("close %q: %v", tmp.Name(), err)
+	}
+	if err := os.Rename(tmp.Name(), local); err != nil {
+		log.Fatalf("cannot move %q into place: %v", local, err)
+	}
+	os.Chtimes(local, e.MTime, e.MTime)
+	fmt.Printf("Downloaded %q (%d bytes) to %s\n", e.Path, e.Size, local)
+	return 0
+}
+
+func ls(dir string) int {
+	conn, status := request(protocol.Request{Op: protocol.OpList, Path: dir})
+	if conn == nil {
+		report(dir, status)
+		return 1
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		e, err := protocol.ReadEntry(r)
+		if err != nil {
+			log.Fatalf("listing cut short: %v", err)
+		}
+		if e.Path == "" {
+			return 0
+		}
+		name := e.Path
+		if e.IsDir() {
+			name += "/"
+		}
+		fmt.Printf("%s %12d %s %s\n", e.FileMode(), e.Size, e.MTime.Local().Format("2006-01-02 15:04"), name)
+	}
+}
+
+func rm(paths []string) int {
+	code := 0
+	for _, p := range paths {
+		conn, status := request(protocol.Request{Op: protocol.OpDelete, Path: p})
+		if conn != nil {
+			conn.Close()
+		} else {
+			code = 1
+		}
+		report(p, status)
+	}
+	return code
+}
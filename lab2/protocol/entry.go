@@ -0,0 +1,117 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"time"
+)
+
+// Entry is one file or directory of a batch upload:
+//
+//	pathLen u16 | path | mode u32 | mtime i64 | size u64  -> ack u8
+//
+// The server acks a directory with its final status. A file it accepts
+// gets StatusOK, followed by the same exchange as a single upload:
+//
+//	<- offset u64
+//	body[offset:] | sumLen u8 | sum                      -> status u8
+//
+// Any other ack rejects the file and the client goes on with the next
+// entry without sending the body. The checksum trailer is only sent when
+// the batch uses a hash algorithm.
+type Entry struct {
+	// Path is slash-separated and relative to the upload directory.
+	Path string
+	// Mode holds Unix file type and permission bits, as in stat(2).
+	Mode  uint32
+	MTime time.Time
+	// Size is always 0 for directories.
+	Size uint64
+}
+
+const (
+	ModeDir  uint32 = 0o040000
+	ModeFile uint32 = 0o100000
+	modeType uint32 = 0o170000
+)
+
+// EntryMode encodes a file mode for the wire; only regular files and
+// directories can be sent.
+func EntryMode(m fs.FileMode) (uint32, error) {
+	switch {
+	case m.IsDir():
+		return ModeDir | uint32(m.Perm()), nil
+	case m.IsRegular():
+		return ModeFile | uint32(m.Perm()), nil
+	default:
+		return 0, fmt.Errorf("cannot send %s", m.Type())
+	}
+}
+
+func (e Entry) IsDir() bool { return e.Mode&modeType == ModeDir }
+
+func (e Entry) Perm() fs.FileMode { return fs.FileMode(e.Mode).Perm() }
+
+// FileMode converts the entry's wire mode for the local file system.
+func (e Entry) FileMode() fs.FileMode {
+	if e.IsDir() {
+		return fs.ModeDir | e.Perm()
+	}
+	return e.Perm()
+}
+
+func (e Entry) Write(w io.Writer) error {
+	if len(e.Path) == 0 || len(e.Path) > MaxNameLen {
+		return fmt.Errorf("bad entry path length %d", len(e.Path))
+	}
+	buf := binary.BigEndian.AppendUint16(nil, uint16(len(e.Path)))
+	buf = append(buf, e.Path...)
+	buf = binary.BigEndian.AppendUint32(buf, e.Mode)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(e.MTime.UnixNano()))
+	buf = binary.BigEndian.AppendUint64(buf, e.Size)
+	_, err := w.Write(buf)
+	return err
+}
+
+// WriteEnd ends a batch.
+func WriteEnd(w io.Writer) error {
+	_, err := w.Write([]byte{0, 0})
+	return err
+}
+
+// ReadEntry returns the next entry of a batch, or one with an empty Path at
+// its end.
+func ReadEntry(r io.Reader) (Entry, error) {
+	var e Entry
+	pathLen, err := readUint16(r)
+	if err != nil {
+		return e, fmt.Errorf("read path length: %w", err)
+	}
+	if pathLen == 0 {
+		return e, nil
+	}
+	path := make([]byte, pathLen)
+	if _, err := io.ReadFull(r, path); err != nil {
+		return e, fmt.Errorf("read path: %w", err)
+	}
+	var b [20]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return e, fmt.Errorf("read entry %q: %w", path, err)
+	}
+	e.Path = string(path)
+	e.Mode = binary.BigEndian.Uint32(b[0:4])
+	e.MTime = time.Unix(0, int64(binary.BigEndian.Uint64(b[4:12])))
+	e.Size = binary.BigEndian.Uint64(b[12:20])
+	switch e.Mode & modeType {
+	case ModeFile:
+	case ModeDir:
+		if e.Size != 0 {
+			return e, fmt.Errorf("directory %q with size %d", e.Path, e.Size)
+		}
+	default:
+		return e, fmt.Errorf("entry %q has unsupported mode %o", e.Path, e.Mode)
+	}
+	return e, nil
+}
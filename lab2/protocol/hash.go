@@ -0,0 +1,57 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+type HashAlg uint8
+
+const (
+	HashNone   HashAlg = 0
+	HashSHA256 HashAlg = 1
+	// HashXXH64 is far cheaper than SHA-256 but only guards against
+	// corruption, not tampering.
+	HashXXH64 HashAlg = 2
+)
+
+func ParseHashAlg(s string) (HashAlg, error) {
+	switch s {
+	case "none", "":
+		return HashNone, nil
+	case "sha256":
+		return HashSHA256, nil
+	case "xxhash":
+		return HashXXH64, nil
+	default:
+		return 0, fmt.Errorf("unknown hash %q, want sha256, xxhash or none", s)
+	}
+}
+
+func (a HashAlg) String() string {
+	switch a {
+	case HashNone:
+		return "none"
+	case HashSHA256:
+		return "sha256"
+	case HashXXH64:
+		return "xxhash"
+	default:
+		return fmt.Sprintf("hash(%d)", uint8(a))
+	}
+}
+
+// New returns a fresh hash, or nil for HashNone and unknown algorithms.
+func (a HashAlg) New() hash.Hash {
+	switch a {
+	case HashSHA256:
+		return sha256.New()
+	case HashXXH64:
+		return xxhash.New()
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,253 @@
+// Package protocol holds the wire format shared by the lab2 client and
+// server.
+//
+// The original upload is
+//
+//	nameLen u16 | name | fileSize u64 | body      -> status u8
+//
+// A zero nameLen is never valid there, so it marks an extended header:
+//
+//	0 u16 | version u8 | idLen u8 | clientID | nameLen u16 | name | fileSize u64
+//	                                          <- offset u64
+//	body[offset:]                             -> status u8
+//
+// where offset is how much of the file the server already holds from an
+// earlier, interrupted upload of the same name and size by the same client.
+//
+// From VersionChecksum on the header ends with a hash algorithm byte and the
+// body is followed by a trailer with the digest of the whole file:
+//
+//	... | fileSize u64 | hashAlg u8   <- offset u64
+//	body[offset:] | sumLen u8 | sum   -> status u8
+//
+// VersionBatch sends any number of files and directories over one
+// connection. Its header has no name or size of its own,
+//
+//	0 u16 | version u8 | idLen u8 | clientID | hashAlg u8
+//
+// and is followed by framed entries, each answered on its own (see Entry),
+// up to an entry with an empty path.
+//
+// From VersionOps on the header only says hello,
+//
+//	0 u16 | version u8 | idLen u8 | clientID   -> version u8
+//
+// and the server answers with the highest version it speaks that is not
+// above the client's, so newer clients can talk down to older servers. A
+// Request follows.
+//
+// From VersionNames on, every final status of a put entry is followed by the
+// path the server stored the file under, which its name collision policy
+// may have changed; it is empty when nothing was stored:
+//
+//	status u8 | nameLen u16 | name
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	extMarker uint16 = 0
+
+	// VersionLegacy is the original protocol without an extended header.
+	VersionLegacy uint8 = 0
+	// VersionResume adds the client id and the resume offset.
+	VersionResume uint8 = 1
+	// VersionChecksum adds the hash algorithm and the checksum trailer.
+	VersionChecksum uint8 = 2
+	// VersionBatch sends a sequence of entries instead of one file.
+	VersionBatch uint8 = 3
+	// VersionOps negotiates the version and sends a Request.
+	VersionOps uint8 = 4
+	// VersionNames returns the stored name with each put entry's status.
+	VersionNames uint8 = 5
+
+	MaxNameLen     = 0xFFFF
+	MaxClientIDLen = 0xFF
+)
+
+const (
+	StatusFailed byte = 0
+	StatusOK     byte = 1
+	// StatusChecksumMismatch means the file arrived but its content did
+	// not match the trailer; the server has discarded it.
+	StatusChecksumMismatch byte = 2
+	// StatusRejected answers a batch entry the server will not accept,
+	// e.g. one whose path would leave the upload directory.
+	StatusRejected byte = 3
+	StatusNotFound byte = 4
+	// StatusExists means the name is taken and the server rejects
+	// uploads that would replace a file.
+	StatusExists byte = 5
+)
+
+type UploadHeader struct {
+	Version  uint8
+	ClientID string
+	Name     string
+	Size     uint64
+	HashAlg  HashAlg
+}
+
+func (h UploadHeader) Write(w io.Writer) error {
+	batch := h.Version >= VersionBatch
+	if !batch && (len(h.Name) == 0 || len(h.Name) > MaxNameLen) {
+		return fmt.Errorf("bad file name length %d", len(h.Name))
+	}
+	var buf []byte
+	if h.Version != VersionLegacy {
+		if len(h.ClientID) > MaxClientIDLen {
+			return fmt.Errorf("client id too long: %d bytes", len(h.ClientID))
+		}
+		buf = binary.BigEndian.AppendUint16(buf, extMarker)
+		buf = append(buf, h.Version, byte(len(h.ClientID)))
+		buf = append(buf, h.ClientID...)
+	}
+	if !batch {
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(h.Name)))
+		buf = append(buf, h.Name...)
+		buf = binary.BigEndian.AppendUint64(buf, h.Size)
+	}
+	if h.Version >= VersionChecksum && h.Version < VersionOps {
+		buf = append(buf, byte(h.HashAlg))
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+func ReadUploadHeader(r io.Reader) (UploadHeader, error) {
+	var h UploadHeader
+	nameLen, err := readUint16(r)
+	if err != nil {
+		return h, fmt.Errorf("read name length: %w", err)
+	}
+	if nameLen == extMarker {
+		var b [2]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return h, fmt.Errorf("read extended header: %w", err)
+		}
+		h.Version = b[0]
+		// Any version from VersionOps on is a hello and gets negotiated.
+		if h.Version < VersionResume {
+			return h, fmt.Errorf("unsupported protocol version %d", h.Version)
+		}
+		id := make([]byte, b[1])
+		if _, err := io.ReadFull(r, id); err != nil {
+			return h, fmt.Errorf("read client id: %w", err)
+		}
+		h.ClientID = string(id)
+		if h.Version >= VersionOps {
+			return h, nil
+		}
+		if h.Version >= VersionBatch {
+			h.HashAlg, err = readHashAlg(r)
+			return h, err
+		}
+		if nameLen, err = readUint16(r); err != nil {
+			return h, fmt.Errorf("read name length: %w", err)
+		}
+		if nameLen == 0 {
+			return h, errors.New("empty file name")
+		}
+	}
+	name := make([]byte, nameLen)
+	if _, err := io.ReadFull(r, name); err != nil {
+		return h, fmt.Errorf("read filename: %w", err)
+	}
+	h.Name = string(name)
+	if h.Size, err = readUint64(r); err != nil {
+		return h, fmt.Errorf("read file size: %w", err)
+	}
+	if h.Version >= VersionChecksum {
+		h.HashAlg, err = readHashAlg(r)
+	}
+	return h, err
+}
+
+func readHashAlg(r io.Reader) (HashAlg, error) {
+	var b [1]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, fmt.Errorf("read hash algorithm: %w", err)
+	}
+	alg := HashAlg(b[0])
+	if alg.New() == nil && alg != HashNone {
+		return 0, fmt.Errorf("unknown hash algorithm %d", b[0])
+	}
+	return alg, nil
+}
+
+func WriteTrailer(w io.Writer, sum []byte) error {
+	if len(sum) > 0xFF {
+		return fmt.Errorf("checksum too long: %d bytes", len(sum))
+	}
+	_, err := w.Write(append([]byte{byte(len(sum))}, sum...))
+	return err
+}
+
+func ReadTrailer(r io.Reader) ([]byte, error) {
+	var n [1]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return nil, err
+	}
+	sum := make([]byte, n[0])
+	_, err := io.ReadFull(r, sum)
+	return sum, err
+}
+
+func WriteVersion(w io.Writer, v uint8) error {
+	_, err := w.Write([]byte{v})
+	return err
+}
+
+func ReadVersion(r io.Reader) (uint8, error) {
+	var b [1]byte
+	_, err := io.ReadFull(r, b[:])
+	return b[0], err
+}
+
+func WriteName(w io.Writer, name string) error {
+	if len(name) > MaxNameLen {
+		return fmt.Errorf("name too long: %d bytes", len(name))
+	}
+	_, err := w.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(name))), name...))
+	return err
+}
+
+func ReadName(r io.Reader) (string, error) {
+	n, err := readUint16(r)
+	if err != nil {
+		return "", err
+	}
+	name := make([]byte, n)
+	_, err = io.ReadFull(r, name)
+	return string(name), err
+}
+
+func WriteOffset(w io.Writer, offset uint64) error {
+	_, err := w.Write(binary.BigEndian.AppendUint64(nil, offset))
+	return err
+}
+
+func ReadOffset(r io.Reader) (uint64, error) {
+	return readUint64(r)
+}
+
+func readUint16(r io.Reader) (uint16, error) {
+	var b [2]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(b[:]), nil
+}
+
+func readUint64(r io.Reader) (uint64, error) {
+	var b [8]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(b[:]), nil
+}
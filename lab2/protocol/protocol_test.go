@@ -0,0 +1,222 @@
+package protocol
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// checkTruncated makes sure read fails on every proper prefix of data
+// instead of returning something half read. Long names are only cut in
+// their first and last 64 bytes, where the fields around them are.
+func checkTruncated(t *testing.T, name string, data []byte, read func(r *bytes.Reader) error) {
+	t.Helper()
+	for n := range len(data) {
+		if n >= 64 && n < len(data)-64 {
+			continue
+		}
+		if err := read(bytes.NewReader(data[:n])); err == nil {
+			t.Errorf("%s: no error for %d of %d bytes", name, n, len(data))
+		}
+	}
+}
+
+func TestUploadHeader(t *testing.T) {
+	long := strings.Repeat("n", MaxNameLen)
+	for _, tc := range []struct {
+		name string
+		hdr  UploadHeader
+	}{
+		{"legacy", UploadHeader{Version: VersionLegacy, Name: "a.txt", Size: 5}},
+		{"legacy longest name", UploadHeader{Version: VersionLegacy, Name: long, Size: 1 << 40}},
+		{"resume", UploadHeader{Version: VersionResume, ClientID: "host", Name: "dir/файл", Size: 7}},
+		{"resume without client id", UploadHeader{Version: VersionResume, Name: "a", Size: 0}},
+		{"checksum", UploadHeader{Version: VersionChecksum, ClientID: strings.Repeat("c", MaxClientIDLen), Name: "a", Size: 1, HashAlg: HashXXH64}},
+		{"batch", UploadHeader{Version: VersionBatch, ClientID: "host", HashAlg: HashSHA256}},
+		{"ops hello", UploadHeader{Version: VersionOps, ClientID: "host"}},
+		{"names hello", UploadHeader{Version: VersionNames}},
+	} {
+		var buf bytes.Buffer
+		if err := tc.hdr.Write(&buf); err != nil {
+			t.Errorf("%s: write: %v", tc.name, err)
+			continue
+		}
+		got, err := ReadUploadHeader(bytes.NewReader(buf.Bytes()))
+		if err != nil || got != tc.hdr {
+			t.Errorf("%s: read back %+v, %v", tc.name, got, err)
+		}
+		checkTruncated(t, tc.name, buf.Bytes(), func(r *bytes.Reader) error {
+			_, err := ReadUploadHeader(r)
+			return err
+		})
+	}
+}
+
+func TestUploadHeaderInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		hdr  UploadHeader
+	}{
+		{"empty name", UploadHeader{Version: VersionChecksum, Name: "", Size: 1}},
+		{"legacy empty name", UploadHeader{Version: VersionLegacy}},
+		{"oversized name", UploadHeader{Version: VersionResume, Name: strings.Repeat("n", MaxNameLen+1)}},
+		{"oversized client id", UploadHeader{Version: VersionOps, ClientID: strings.Repeat("c", MaxClientIDLen+1)}},
+	} {
+		if err := tc.hdr.Write(&bytes.Buffer{}); err == nil {
+			t.Errorf("write %s: no error", tc.name)
+		}
+	}
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"extended version 0", []byte{0, 0, VersionLegacy, 0}},
+		{"extended empty name", []byte{0, 0, VersionResume, 1, 'c', 0, 0}},
+		{"unknown hash", append([]byte{0, 0, VersionChecksum, 0, 0, 1, 'a'}, 0, 0, 0, 0, 0, 0, 0, 1, 9)},
+		{"batch unknown hash", []byte{0, 0, VersionBatch, 0, 9}},
+	} {
+		if hdr, err := ReadUploadHeader(bytes.NewReader(tc.data)); err == nil {
+			t.Errorf("read %s: accepted as %+v", tc.name, hdr)
+		}
+	}
+}
+
+func TestRequest(t *testing.T) {
+	for _, q := range []Request{
+		{Op: OpPut, HashAlg: HashSHA256},
+		{Op: OpList},
+		{Op: OpList, Path: "dir/sub"},
+		{Op: OpGet, Path: "dir/файл.txt", HashAlg: HashXXH64},
+		{Op: OpGet, Path: strings.Repeat("p", MaxNameLen), HashAlg: HashNone},
+		{Op: OpDelete, Path: "a"},
+	} {
+		var buf bytes.Buffer
+		if err := q.Write(&buf); err != nil {
+			t.Errorf("%s %q: write: %v", q.Op, q.Path, err)
+			continue
+		}
+		got, err := ReadRequest(bytes.NewReader(buf.Bytes()))
+		if err != nil || got != q {
+			t.Errorf("%s %q: read back %+v, %v", q.Op, q.Path, got, err)
+		}
+		checkTruncated(t, q.Op.String(), buf.Bytes(), func(r *bytes.Reader) error {
+			_, err := ReadRequest(r)
+			return err
+		})
+	}
+
+	for _, op := range []Op{OpList, OpGet, OpDelete} {
+		q := Request{Op: op, Path: strings.Repeat("p", MaxNameLen+1)}
+		if err := q.Write(&bytes.Buffer{}); err == nil {
+			t.Errorf("%s: oversized path written", op)
+		}
+	}
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"op 0", []byte{0}},
+		{"unknown op", []byte{9, 0, 0}},
+		{"get unknown hash", []byte{byte(OpGet), 0, 1, 'a', 9}},
+		{"put unknown hash", []byte{byte(OpPut), 9}},
+	} {
+		if q, err := ReadRequest(bytes.NewReader(tc.data)); err == nil {
+			t.Errorf("%s: accepted as %+v", tc.name, q)
+		}
+	}
+}
+
+func TestName(t *testing.T) {
+	for _, name := range []string{"", "a.txt", "dir/файл (1).txt", strings.Repeat("n", MaxNameLen)} {
+		var buf bytes.Buffer
+		if err := WriteName(&buf, name); err != nil {
+			t.Errorf("%.20q: write: %v", name, err)
+			continue
+		}
+		got, err := ReadName(bytes.NewReader(buf.Bytes()))
+		if err != nil || got != name {
+			t.Errorf("%.20q: read back %.20q, %v", name, got, err)
+		}
+		checkTruncated(t, name, buf.Bytes(), func(r *bytes.Reader) error {
+			_, err := ReadName(r)
+			return err
+		})
+	}
+	if err := WriteName(&bytes.Buffer{}, strings.Repeat("n", MaxNameLen+1)); err == nil {
+		t.Error("oversized name written")
+	}
+}
+
+func TestTrailer(t *testing.T) {
+	for _, sum := range [][]byte{{}, HashSHA256.New().Sum(nil), HashXXH64.New().Sum(nil), bytes.Repeat([]byte{0xAB}, 0xFF)} {
+		var buf bytes.Buffer
+		if err := WriteTrailer(&buf, sum); err != nil {
+			t.Errorf("%d byte sum: write: %v", len(sum), err)
+			continue
+		}
+		if buf.Len() != 1+len(sum) {
+			t.Errorf("%d byte sum: trailer of %d bytes", len(sum), buf.Len())
+		}
+		got, err := ReadTrailer(bytes.NewReader(buf.Bytes()))
+		if err != nil || !bytes.Equal(got, sum) {
+			t.Errorf("%d byte sum: read back %x, %v", len(sum), got, err)
+		}
+		checkTruncated(t, "trailer", buf.Bytes(), func(r *bytes.Reader) error {
+			_, err := ReadTrailer(r)
+			return err
+		})
+	}
+	if err := WriteTrailer(&bytes.Buffer{}, make([]byte, 0x100)); err == nil {
+		t.Error("oversized sum written")
+	}
+}
+
+func TestEntry(t *testing.T) {
+	mtime := time.Date(2025, 3, 1, 12, 0, 0, 123, time.UTC)
+	for _, e := range []Entry{
+		{Path: "dir", Mode: ModeDir | 0o755, MTime: mtime},
+		{Path: "dir/a.txt", Mode: ModeFile | 0o644, MTime: mtime, Size: 1 << 33},
+	} {
+		var buf bytes.Buffer
+		if err := e.Write(&buf); err != nil {
+			t.Errorf("%s: write: %v", e.Path, err)
+			continue
+		}
+		got, err := ReadEntry(bytes.NewReader(buf.Bytes()))
+		if err != nil || got.Path != e.Path || got.Mode != e.Mode || !got.MTime.Equal(e.MTime) || got.Size != e.Size {
+			t.Errorf("%s: read back %+v, %v", e.Path, got, err)
+		}
+		checkTruncated(t, e.Path, buf.Bytes(), func(r *bytes.Reader) error {
+			_, err := ReadEntry(r)
+			return err
+		})
+	}
+
+	var buf bytes.Buffer
+	WriteEnd(&buf)
+	if e, err := ReadEntry(&buf); err != nil || e.Path != "" {
+		t.Errorf("end of batch read as %+v, %v", e, err)
+	}
+	for _, e := range []Entry{
+		{Path: "", Mode: ModeFile},
+		{Path: strings.Repeat("p", MaxNameLen+1), Mode: ModeFile},
+	} {
+		if err := e.Write(&bytes.Buffer{}); err == nil {
+			t.Errorf("entry with %d byte path written", len(e.Path))
+		}
+	}
+	for _, e := range []Entry{
+		{Path: "dir", Mode: ModeDir | 0o755, Size: 1},
+		{Path: "link", Mode: 0o120777},
+	} {
+		var buf bytes.Buffer
+		if err := e.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadEntry(&buf); err == nil {
+			t.Errorf("%s: mode %o size %d accepted", e.Path, e.Mode, e.Size)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Op selects what a VersionOps connection does.
+type Op uint8
+
+const (
+	// OpPut is a batch upload: op | hashAlg u8, then entries as with
+	// VersionBatch.
+	OpPut Op = 1
+	// OpList lists the stored tree at or below path:
+	//
+	//	op | pathLen u16 | path   -> status u8 | entries | 0 u16
+	//
+	// where an empty path is the whole upload directory.
+	OpList Op = 2
+	// OpGet downloads a stored file:
+	//
+	//	op | pathLen u16 | path | hashAlg u8
+	//	    -> status u8 | entry | body | sumLen u8 | sum
+	//
+	// with everything after the status only sent for StatusOK, and an
+	// empty sum for HashNone.
+	OpGet Op = 3
+	// OpDelete removes a file or an empty directory:
+	//
+	//	op | pathLen u16 | path   -> status u8
+	OpDelete Op = 4
+)
+
+func (o Op) String() string {
+	switch o {
+	case OpPut:
+		return "put"
+	case OpList:
+		return "list"
+	case OpGet:
+		return "get"
+	case OpDelete:
+		return "delete"
+	default:
+		return fmt.Sprintf("op(%d)", uint8(o))
+	}
+}
+
+type Request struct {
+	Op Op
+	// Path is slash-separated and relative to the upload directory; put
+	// has none.
+	Path    string
+	HashAlg HashAlg
+}
+
+func (q Request) Write(w io.Writer) error {
+	buf := []byte{byte(q.Op)}
+	if q.Op != OpPut {
+		if len(q.Path) > MaxNameLen {
+			return fmt.Errorf("path too long: %d bytes", len(q.Path))
+		}
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(q.Path)))
+		buf = append(buf, q.Path...)
+	}
+	if q.Op == OpPut || q.Op == OpGet {
+		buf = append(buf, byte(q.HashAlg))
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+func ReadRequest(r io.Reader) (Request, error) {
+	var q Request
+	var b [1]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return q, fmt.Errorf("read op: %w", err)
+	}
+	q.Op = Op(b[0])
+	switch q.Op {
+	case OpPut, OpList, OpGet, OpDelete:
+	default:
+		return q, fmt.Errorf("unknown %s", q.Op)
+	}
+	if q.Op != OpPut {
+		n, err := readUint16(r)
+		if err != nil {
+			return q, fmt.Errorf("read path length: %w", err)
+		}
+		path := make([]byte, n)
+		if _, err := io.ReadFull(r, path); err != nil {
+			return q, fmt.Errorf("read path: %w", err)
+		}
+		q.Path = string(path)
+	}
+	if q.Op == OpPut || q.Op == OpGet {
+		var err error
+		if q.HashAlg, err = readHashAlg(r); err != nil {
+			return q, err
+		}
+	}
+	return q, nil
+}
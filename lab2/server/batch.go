@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"log"
+	"net"
+
+	"networks_nsu/lab2/protocol"
+	"networks_nsu/lab2/storage"
+)
+
+// receiveBatch stores the entries of a VersionBatch upload in st,
+// recreating the client's tree, and answers each one on its own.
+func receiveBatch(conn net.Conn, r *bufio.Reader, st storage.Storage, client string, hdr protocol.UploadHeader) {
+	var files, dirs, failed int
+	// reply sends the final status of an entry, and from VersionNames on
+	// the name it was stored under.
+	reply := func(status byte, stored string) bool {
+		if status != protocol.StatusOK {
+			failed++
+		}
+		buf := bytes.NewBuffer([]byte{status})
+		if hdr.Version >= protocol.VersionNames {
+			protocol.WriteName(buf, stored)
+		}
+		if _, err := conn.Write(buf.Bytes()); err != nil {
+			log.Printf("[%s] failed to send response: %v", conn.RemoteAddr(), err)
+			return false
+		}
+		return true
+	}
+
+	for {
+		e, err := protocol.ReadEntry(r)
+		if err != nil {
+			log.Printf("[%s] failed to read entry: %v", conn.RemoteAddr(), err)
+			return
+		}
+		if e.Path == "" {
+			log.Printf("[%s] batch from %s done: %d files, %d directories, %d failed", conn.RemoteAddr(), client, files, dirs, failed)
+			return
+		}
+		dst, err := storage.CleanName(e.Path)
+		if err != nil {
+			log.Printf("[%s] rejected %q: %v", conn.RemoteAddr(), e.Path, err)
+			if !reply(protocol.StatusRejected, "") {
+				return
+			}
+			continue
+		}
+
+		if e.IsDir() {
+			// The owner keeps write access so that the entries inside can
+			// still be created.
+			status, stored := protocol.StatusOK, dst
+			if err := st.Mkdir(dst, e.Perm()|0700); err != nil {
+				log.Printf("[%s] cannot create directory %q: %v", conn.RemoteAddr(), dst, err)
+				status, stored = protocol.StatusFailed, ""
+			} else {
+				dirs++
+			}
+			if !reply(status, stored) {
+				return
+			}
+			continue
+		}
+
+		fhdr := protocol.UploadHeader{
+			Version:  hdr.Version,
+			ClientID: hdr.ClientID,
+			Name:     e.Path,
+			Size:     e.Size,
+			HashAlg:  hdr.HashAlg,
+		}
+		if refuses(st, dst) {
+			log.Printf("[%s] refused %q, the name is taken", conn.RemoteAddr(), e.Path)
+			if !reply(protocol.StatusExists, "") {
+				return
+			}
+			continue
+		}
+		key := partialKey(fhdr)
+		if !claimPartial(key) {
+			log.Printf("[%s] %q is already being uploaded", conn.RemoteAddr(), e.Path)
+			if !reply(protocol.StatusFailed, "") {
+				return
+			}
+			continue
+		}
+		// The go-ahead for the body carries no name.
+		if _, err := conn.Write([]byte{protocol.StatusOK}); err != nil {
+			log.Printf("[%s] failed to send response: %v", conn.RemoteAddr(), err)
+			releasePartial(key)
+			return
+		}
+		status, stored, err := receiveFile(conn, r, st, client, fhdr, key, dst, &e)
+		releasePartial(key)
+		if status == protocol.StatusOK {
+			files++
+		}
+		if !reply(status, stored) || err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"io"
+	"io/fs"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"networks_nsu/lab2/protocol"
+)
+
+type testEntry struct {
+	protocol.Entry
+	data []byte
+	// corrupt sends a checksum that does not match data.
+	corrupt bool
+}
+
+// sendBatch uploads entries over one connection, as a VersionBatch upload
+// or a put request of a later version, and returns the status of each and
+// the name it was stored under where the version says.
+func sendBatch(t *testing.T, addr string, version uint8, entries []testEntry) ([]byte, []string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	w := bufio.NewWriter(conn)
+	r := bufio.NewReader(conn)
+
+	hdr := protocol.UploadHeader{Version: version, ClientID: "test", HashAlg: protocol.HashSHA256}
+	if err := hdr.Write(w); err != nil {
+		t.Fatal(err)
+	}
+	if version >= protocol.VersionOps {
+		w.Flush()
+		if v, err := protocol.ReadVersion(r); err != nil || v != version {
+			t.Fatalf("negotiated version %d, %v", v, err)
+		}
+		if err := (protocol.Request{Op: protocol.OpPut, HashAlg: protocol.HashSHA256}).Write(w); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readByte := func() byte {
+		b, err := r.ReadByte()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	var statuses []byte
+	var names []string
+	done := func(status byte) {
+		statuses = append(statuses, status)
+		if version >= protocol.VersionNames {
+			name, err := protocol.ReadName(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, name)
+		}
+	}
+	for _, e := range entries {
+		e.Size = uint64(len(e.data))
+		if err := e.Write(w); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		ack := readByte()
+		if e.IsDir() || ack != protocol.StatusOK {
+			done(ack)
+			continue
+		}
+		if _, err := protocol.ReadOffset(r); err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256(e.data)
+		if e.corrupt {
+			sum[0] ^= 1
+		}
+		w.Write(e.data)
+		if err := protocol.WriteTrailer(w, sum[:]); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		done(readByte())
+	}
+	if err := protocol.WriteEnd(w); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Errorf("server did not close the connection after the batch: %v", err)
+	}
+	return statuses, names
+}
+
+func TestBatchUpload(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := serve(t, ln)
+
+	mtime := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	file := func(path string, perm uint32, data string) testEntry {
+		return testEntry{Entry: protocol.Entry{Path: path, Mode: protocol.ModeFile | perm, MTime: mtime}, data: []byte(data)}
+	}
+	bad := file("tree/bad.txt", 0644, "garbled")
+	bad.corrupt = true
+	entries := []testEntry{
+		{Entry: protocol.Entry{Path: "tree/empty", Mode: protocol.ModeDir | 0750, MTime: mtime}},
+		file("tree/a.txt", 0640, "alpha"),
+		file("../escape.txt", 0644, "out"),
+		file("/etc/abs.txt", 0644, "out"),
+		file("tree/../../escape.txt", 0644, "out"),
+		file(".partial/planted", 0644, "out"),
+		bad,
+		file("tree/sub/deep/b.txt", 0600, "beta"),
+	}
+	want := []byte{
+		protocol.StatusOK,
+		protocol.StatusOK,
+		protocol.StatusRejected,
+		protocol.StatusRejected,
+		protocol.StatusRejected,
+		protocol.StatusRejected,
+		protocol.StatusChecksumMismatch,
+		protocol.StatusOK,
+	}
+
+	got, _ := sendBatch(t, ln.Addr().String(), protocol.VersionBatch, entries)
+	if string(got) != string(want) {
+		t.Fatalf("statuses = %v, want %v", got, want)
+	}
+
+	for path, data := range map[string]string{"tree/a.txt": "alpha", "tree/sub/deep/b.txt": "beta"} {
+		b, err := readStored(st, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != data {
+			t.Errorf("%s = %q, want %q", path, b, data)
+		}
+	}
+	for path, perm := range map[string]fs.FileMode{"tree/a.txt": 0640, "tree/sub/deep/b.txt": 0600, "tree/empty": 0750} {
+		fi, err := st.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode.Perm() != perm {
+			t.Errorf("%s mode %v, want %v", path, fi.Mode.Perm(), perm)
+		}
+		if !fi.IsDir() && !fi.ModTime.Equal(mtime) {
+			t.Errorf("%s mtime %v, want %v", path, fi.ModTime, mtime)
+		}
+	}
+	// Nothing else, rejected or corrupt, made it into the store.
+	infos, err := st.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fi := range infos {
+		names = append(names, fi.Name)
+	}
+	stored := []string{"tree", "tree/a.txt", "tree/empty", "tree/sub", "tree/sub/deep", "tree/sub/deep/b.txt"}
+	if !reflect.DeepEqual(names, stored) {
+		t.Errorf("stored %q, want %q", names, stored)
+	}
+}
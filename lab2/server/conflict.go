@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+
+	"networks_nsu/lab2/storage"
+)
+
+// commit stores the partial upload key as dst under the conflict policy
+// and returns the name it was stored under, counting the conflicts it
+// runs into.
+func commit(st storage.Storage, key, dst string, meta storage.Meta) (string, error) {
+	taken := false
+	if onConflict == storage.Overwrite {
+		_, err := st.Stat(dst)
+		taken = err == nil
+	}
+	stored, err := st.Commit(key, dst, meta, onConflict)
+	if taken || errors.Is(err, storage.ErrExists) || err == nil && stored != dst {
+		conflicts.WithLabelValues(onConflict.String()).Inc()
+	}
+	return stored, err
+}
+
+// refuses reports whether an upload to dst would be refused, so that its
+// body need not be sent at all.
+func refuses(st storage.Storage, dst string) bool {
+	if onConflict != storage.Reject {
+		return false
+	}
+	if _, err := st.Stat(dst); err != nil {
+		return false
+	}
+	conflicts.WithLabelValues(onConflict.String()).Inc()
+	return true
+}
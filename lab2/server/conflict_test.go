@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"networks_nsu/lab2/protocol"
+	"networks_nsu/lab2/storage"
+)
+
+func TestConflictPolicies(t *testing.T) {
+	upload := func(data string) testEntry {
+		return testEntry{
+			Entry: protocol.Entry{Path: "docs/report.txt", Mode: protocol.ModeFile | 0644, MTime: time.Now()},
+			data:  []byte(data),
+		}
+	}
+	for _, tc := range []struct {
+		policy   storage.Policy
+		statuses []byte
+		names    []string
+		stored   map[string]string
+	}{
+		{
+			storage.Overwrite,
+			[]byte{protocol.StatusOK, protocol.StatusOK, protocol.StatusOK},
+			[]string{"docs/report.txt", "docs/report.txt", "docs/report.txt"},
+			map[string]string{"docs/report.txt": "three"},
+		},
+		{
+			storage.Rename,
+			[]byte{protocol.StatusOK, protocol.StatusOK, protocol.StatusOK},
+			[]string{"docs/report.txt", "docs/report-1.txt", "docs/report-2.txt"},
+			map[string]string{"docs/report.txt": "one", "docs/report-1.txt": "two", "docs/report-2.txt": "three"},
+		},
+		{
+			storage.Reject,
+			[]byte{protocol.StatusOK, protocol.StatusExists, protocol.StatusExists},
+			[]string{"docs/report.txt", "", ""},
+			map[string]string{"docs/report.txt": "one"},
+		},
+	} {
+		t.Run(tc.policy.String(), func(t *testing.T) {
+			saved := onConflict
+			onConflict = tc.policy
+			t.Cleanup(func() { onConflict = saved })
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			st := serve(t, ln)
+
+			var statuses []byte
+			var names []string
+			for _, data := range []string{"one", "two", "three"} {
+				s, n := sendBatch(t, ln.Addr().String(), protocol.VersionNames, []testEntry{upload(data)})
+				statuses = append(statuses, s...)
+				names = append(names, n...)
+			}
+			if string(statuses) != string(tc.statuses) {
+				t.Errorf("statuses = %v, want %v", statuses, tc.statuses)
+			}
+			for i := range tc.names {
+				if names[i] != tc.names[i] {
+					t.Errorf("upload %d stored as %q, want %q", i+1, names[i], tc.names[i])
+				}
+			}
+			files, err := st.List("docs")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != len(tc.stored) {
+				t.Errorf("stored %d files, want %d", len(files), len(tc.stored))
+			}
+			for name, want := range tc.stored {
+				if got, err := readStored(st, name); err != nil || string(got) != want {
+					t.Errorf("%s = %q, %v; want %q", name, got, err, want)
+				}
+			}
+		})
+	}
+}
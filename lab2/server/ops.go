@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+
+	"networks_nsu/lab2/protocol"
+	"networks_nsu/lab2/storage"
+)
+
+// serveOps negotiates the protocol version with a VersionOps client and
+// carries out its request.
+func serveOps(conn net.Conn, r *bufio.Reader, st storage.Storage, client string, hdr protocol.UploadHeader) {
+	hdr.Version = min(hdr.Version, protocol.VersionNames)
+	if err := protocol.WriteVersion(conn, hdr.Version); err != nil {
+		log.Printf("[%s] failed to send version: %v", conn.RemoteAddr(), err)
+		return
+	}
+	q, err := protocol.ReadRequest(r)
+	if err != nil {
+		log.Printf("[%s] failed to read request: %v", conn.RemoteAddr(), err)
+		return
+	}
+	requests.WithLabelValues(q.Op.String()).Inc()
+	switch q.Op {
+	case protocol.OpPut:
+		hdr.HashAlg = q.HashAlg
+		receiveBatch(conn, r, st, client, hdr)
+	case protocol.OpList:
+		list(conn, st, q.Path)
+	case protocol.OpGet:
+		sendStored(conn, st, client, q)
+	case protocol.OpDelete:
+		remove(conn, st, q.Path)
+	}
+}
+
+// lookup resolves the path of a request and returns the status to fail it
+// with, or StatusOK. An empty path is the whole store when allowed.
+func lookup(conn net.Conn, st storage.Storage, p string, allowRoot bool) (storage.Info, byte) {
+	name := ""
+	if p != "" || !allowRoot {
+		var err error
+		if name, err = storage.CleanName(p); err != nil {
+			log.Printf("[%s] rejected %q: %v", conn.RemoteAddr(), p, err)
+			return storage.Info{}, protocol.StatusRejected
+		}
+	}
+	fi, err := st.Stat(name)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return storage.Info{}, protocol.StatusNotFound
+	case err != nil:
+		log.Printf("[%s] stat %q: %v", conn.RemoteAddr(), name, err)
+		return storage.Info{}, protocol.StatusFailed
+	}
+	return fi, protocol.StatusOK
+}
+
+func writeStatus(conn net.Conn, status byte) bool {
+	if _, err := conn.Write([]byte{status}); err != nil {
+		log.Printf("[%s] failed to send response: %v", conn.RemoteAddr(), err)
+		return false
+	}
+	return true
+}
+
+// list sends the files and directories at or below p.
+func list(conn net.Conn, st storage.Storage, p string) {
+	fi, status := lookup(conn, st, p, true)
+	name := fi.Name
+	var infos []storage.Info
+	if status == protocol.StatusOK {
+		var err error
+		if infos, err = st.List(name); err != nil {
+			log.Printf("[%s] listing %q failed: %v", conn.RemoteAddr(), name, err)
+			status = protocol.StatusFailed
+		}
+	}
+	if !writeStatus(conn, status) || status != protocol.StatusOK {
+		return
+	}
+
+	w := bufio.NewWriter(conn)
+	count := 0
+	var err error
+	for _, fi := range infos {
+		mode, merr := protocol.EntryMode(fi.Mode)
+		if merr != nil {
+			// Not something a client could have uploaded.
+			continue
+		}
+		e := protocol.Entry{Path: fi.Name, Mode: mode, MTime: fi.ModTime, Size: uint64(fi.Size)}
+		if err = e.Write(w); err != nil {
+			break
+		}
+		count++
+	}
+	if err == nil {
+		err = protocol.WriteEnd(w)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		log.Printf("[%s] failed to send listing: %v", conn.RemoteAddr(), err)
+		return
+	}
+	log.Printf("[%s] listed %d entries under %q", conn.RemoteAddr(), count, name)
+}
+
+// sendStored streams a stored file back together with its checksum.
+func sendStored(conn net.Conn, st storage.Storage, client string, q protocol.Request) {
+	fi, status := lookup(conn, st, q.Path, false)
+	name := fi.Name
+	if status == protocol.StatusOK && !fi.Mode.IsRegular() {
+		log.Printf("[%s] cannot send %q: not a regular file", conn.RemoteAddr(), name)
+		status = protocol.StatusFailed
+	}
+	var f io.ReadCloser
+	if status == protocol.StatusOK {
+		var err error
+		if f, fi, err = st.Open(name); err != nil {
+			log.Printf("[%s] cannot open %q: %v", conn.RemoteAddr(), name, err)
+			status = protocol.StatusFailed
+		} else {
+			defer f.Close()
+		}
+	}
+	if !writeStatus(conn, status) || status != protocol.StatusOK {
+		return
+	}
+
+	w := bufio.NewWriter(conn)
+	e := protocol.Entry{Path: name, Mode: protocol.ModeFile | uint32(fi.Mode.Perm()), MTime: fi.ModTime, Size: uint64(fi.Size)}
+	if err := e.Write(w); err != nil {
+		log.Printf("[%s] failed to send entry: %v", conn.RemoteAddr(), err)
+		return
+	}
+	var body io.Reader = io.LimitReader(f, fi.Size)
+	h := q.HashAlg.New()
+	if h != nil {
+		body = io.TeeReader(body, h)
+	}
+	n, err := io.Copy(w, body)
+	bytesSent.WithLabelValues(client).Add(float64(n))
+	if err == nil && n != fi.Size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		// Closing the connection mid-body tells the client.
+		log.Printf("[%s] sending %q failed after %d bytes: %v", conn.RemoteAddr(), name, n, err)
+		return
+	}
+	var sum []byte
+	if h != nil {
+		sum = h.Sum(nil)
+	}
+	if err = protocol.WriteTrailer(w, sum); err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		log.Printf("[%s] sending %q failed: %v", conn.RemoteAddr(), name, err)
+		return
+	}
+	log.Printf("[%s] sent %q (%d bytes) to %s", conn.RemoteAddr(), name, n, client)
+}
+
+// remove deletes a stored file or empty directory.
+func remove(conn net.Conn, st storage.Storage, p string) {
+	fi, status := lookup(conn, st, p, false)
+	name := fi.Name
+	if status == protocol.StatusOK {
+		if err := st.Remove(name); err != nil {
+			log.Printf("[%s] cannot delete %q: %v", conn.RemoteAddr(), name, err)
+			status = protocol.StatusFailed
+		} else {
+			log.Printf("[%s] deleted %q", conn.RemoteAddr(), name)
+		}
+	}
+	writeStatus(conn, status)
+}
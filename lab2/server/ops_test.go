@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"networks_nsu/lab2/protocol"
+	"networks_nsu/lab2/storage"
+)
+
+// store puts data into st as name.
+func store(t *testing.T, st storage.Storage, name, data string, meta storage.Meta) {
+	t.Helper()
+	p, err := st.Create("seed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+	if _, err := st.Commit("seed", name, meta, storage.Overwrite); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// request sends q after a hello claiming version, checks that the server
+// talks down to what it supports and returns the status of the request.
+func request(t *testing.T, addr string, version uint8, q protocol.Request) (byte, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	r := bufio.NewReader(conn)
+
+	if err := (protocol.UploadHeader{Version: version, ClientID: "test"}).Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	v, err := protocol.ReadVersion(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := min(version, protocol.VersionNames); v != want {
+		t.Fatalf("server speaks version %d, want %d", v, want)
+	}
+	if err := q.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	status, err := r.ReadByte()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status, r
+}
+
+func TestOps(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := serve(t, ln)
+	addr := ln.Addr().String()
+
+	mtime := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for path, data := range map[string]string{"a.txt": "alpha", "dir/b.txt": "beta"} {
+		store(t, st, path, data, storage.Meta{Perm: 0640, ModTime: mtime})
+	}
+	if p, err := st.Create("unfinished"); err == nil {
+		p.Write([]byte("x"))
+		p.Close()
+	}
+
+	t.Run("list", func(t *testing.T) {
+		// A client newer than the server is talked down.
+		status, r := request(t, addr, protocol.VersionNames+1, protocol.Request{Op: protocol.OpList})
+		if status != protocol.StatusOK {
+			t.Fatalf("status = %d", status)
+		}
+		got := map[string]protocol.Entry{}
+		for {
+			e, err := protocol.ReadEntry(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e.Path == "" {
+				break
+			}
+			got[e.Path] = e
+		}
+		if len(got) != 3 || !got["dir"].IsDir() {
+			t.Fatalf("listing %v, want a.txt, dir and dir/b.txt", got)
+		}
+		if e := got["dir/b.txt"]; e.Size != 4 || e.Perm() != 0640 || !e.MTime.Equal(mtime) {
+			t.Errorf("dir/b.txt listed as %+v", e)
+		}
+	})
+
+	t.Run("get", func(t *testing.T) {
+		status, r := request(t, addr, protocol.VersionOps, protocol.Request{Op: protocol.OpGet, Path: "dir/b.txt", HashAlg: protocol.HashSHA256})
+		if status != protocol.StatusOK {
+			t.Fatalf("status = %d", status)
+		}
+		e, err := protocol.ReadEntry(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := make([]byte, e.Size)
+		if _, err := io.ReadFull(r, body); err != nil {
+			t.Fatal(err)
+		}
+		sum, err := protocol.ReadTrailer(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := sha256.Sum256([]byte("beta")); string(body) != "beta" || string(sum) != string(want[:]) {
+			t.Errorf("got %q with checksum %x", body, sum)
+		}
+	})
+
+	for name, tc := range map[string]struct {
+		q    protocol.Request
+		want byte
+	}{
+		"get missing":       {protocol.Request{Op: protocol.OpGet, Path: "nope"}, protocol.StatusNotFound},
+		"get directory":     {protocol.Request{Op: protocol.OpGet, Path: "dir"}, protocol.StatusFailed},
+		"get outside":       {protocol.Request{Op: protocol.OpGet, Path: "../x"}, protocol.StatusRejected},
+		"get partial":       {protocol.Request{Op: protocol.OpGet, Path: ".partial/unfinished"}, protocol.StatusRejected},
+		"delete nonempty":   {protocol.Request{Op: protocol.OpDelete, Path: "dir"}, protocol.StatusFailed},
+		"delete outside":    {protocol.Request{Op: protocol.OpDelete, Path: "/etc/passwd"}, protocol.StatusRejected},
+		"delete upload dir": {protocol.Request{Op: protocol.OpDelete, Path: ""}, protocol.StatusRejected},
+		"list missing":      {protocol.Request{Op: protocol.OpList, Path: "nope"}, protocol.StatusNotFound},
+		"delete file":       {protocol.Request{Op: protocol.OpDelete, Path: "a.txt"}, protocol.StatusOK},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if status, _ := request(t, addr, protocol.VersionOps, tc.q); status != tc.want {
+				t.Errorf("status = %d, want %d", status, tc.want)
+			}
+		})
+	}
+	if _, err := st.Stat("a.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("a.txt still stored: %v", err)
+	}
+}
+
+// failingConn takes the first limit bytes written to it and fails every
+// write after that.
+type failingConn struct {
+	net.Conn
+	limit int
+}
+
+func (c *failingConn) Write(b []byte) (int, error) {
+	if len(b) > c.limit {
+		n := c.limit
+		c.limit = 0
+		return n, errors.New("connection broke")
+	}
+	c.limit -= len(b)
+	return len(b), nil
+}
+
+// TestSendStoredWriteFailure checks that a download whose tail cannot be
+// written is reported as failed rather than sent.
+func TestSendStoredWriteFailure(t *testing.T) {
+	st := storage.NewMemory()
+	store(t, st, "f.txt", "contents", storage.Meta{})
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	for _, tc := range []struct {
+		limit int
+		want  string
+	}{
+		// Only the status fits; the entry, body and trailer go out in one
+		// flush, which fails.
+		{1, "sending \"f.txt\" failed"},
+		{1 << 20, "sent \"f.txt\""},
+	} {
+		logged.Reset()
+		c, peer := net.Pipe()
+		conn := &failingConn{Conn: c, limit: tc.limit}
+		sendStored(conn, st, "test", protocol.Request{Op: protocol.OpGet, Path: "f.txt", HashAlg: protocol.HashSHA256})
+		c.Close()
+		peer.Close()
+		if !strings.Contains(logged.String(), tc.want) {
+			t.Errorf("with %d writable bytes logged %q, want %q", tc.limit, logged.String(), tc.want)
+		}
+	}
+}
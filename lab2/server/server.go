@@ -2,19 +2,26 @@ package main
 
 import (
 	"bufio"
-	"encoding/binary"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
-	"os"
 	"path/filepath"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"networks_nsu/lab2/protocol"
+	"networks_nsu/lab2/storage"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
@@ -22,17 +29,41 @@ import (
 var (
 	port        = flag.Int("port", 9000, "TCP port to listen on")
 	metricsPort = flag.Int("metrics-port", 2112, "HTTP port to serve Prometheus metrics")
+	tlsCert     = flag.String("tls-cert", "", "PEM certificate; enables TLS together with -tls-key")
+	tlsKey      = flag.String("tls-key", "", "PEM private key of -tls-cert")
+	clientCA    = flag.String("client-ca", "", "PEM CA bundle; when set clients must present a certificate it signed")
+	conflict    = flag.String("on-conflict", "overwrite", "what to do with an upload whose name is taken: overwrite, rename (adding -1, -2, ...) or reject")
+	backend     = flag.String("storage", "fs", "where uploads are kept: fs (files under their names), cas (deduplicated by content) or memory (lost on exit)")
+	storageRoot = flag.String("root", "uploads", "directory of the fs and cas storage")
+	partialAge  = flag.Duration("partial-max-age", 7*24*time.Hour, "remove partial uploads nobody resumed for this long; 0 keeps them forever")
 )
 
+// onConflict is the parsed -on-conflict.
+var onConflict storage.Policy
+
 var (
-	bytesReceived = prometheus.NewCounter(prometheus.CounterOpts{
+	// The client label is the subject of the client certificate, or
+	// "anonymous" without mutual TLS.
+	bytesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "file_server_bytes_received_total",
 		Help: "Total number of bytes received by the server",
-	})
-	fileTransfers = prometheus.NewCounter(prometheus.CounterOpts{
+	}, []string{"client"})
+	fileTransfers = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "file_server_transfers_total",
 		Help: "Total number of completed file transfers",
-	})
+	}, []string{"client"})
+	bytesSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "file_server_bytes_sent_total",
+		Help: "Total number of bytes of stored files sent back to clients",
+	}, []string{"client"})
+	conflicts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "file_server_name_conflicts_total",
+		Help: "Uploads whose name was already taken, by the policy applied",
+	}, []string{"policy"})
+	requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "file_server_requests_total",
+		Help: "Requests by operation; uploads from clients that predate operations count as put",
+	}, []string{"op"})
 	transferDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
 		Name:    "file_server_transfer_duration_seconds",
 		Help:    "Histogram of file transfer durations in seconds",
@@ -42,15 +73,104 @@ var (
 		Name: "file_server_active_connections",
 		Help: "Current number of active client connections",
 	})
+	resumedTransfers = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "file_server_resumed_transfers_total",
+		Help: "Total number of uploads that continued a partial file",
+	})
+	// The outcome is "match", or "mismatch" for an upload that was
+	// discarded.
+	checksumVerifications = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "file_server_checksum_verifications_total",
+		Help: "Uploads checked against the client's checksum, by algorithm and outcome",
+	}, []string{"algorithm", "outcome"})
 )
 
 func init() {
-	prometheus.MustRegister(bytesReceived, fileTransfers, transferDuration, activeConnections)
+	prometheus.MustRegister(bytesReceived, fileTransfers, bytesSent, requests, conflicts, transferDuration,
+		activeConnections, resumedTransfers, checksumVerifications)
+}
+
+// activePartials guards against two connections writing the same partial
+// file, e.g. a client retrying before the server noticed the old
+// connection died.
+var activePartials = struct {
+	sync.Mutex
+	m map[string]bool
+}{m: make(map[string]bool)}
+
+func claimPartial(key string) bool {
+	activePartials.Lock()
+	defer activePartials.Unlock()
+	if activePartials.m[key] {
+		return false
+	}
+	activePartials.m[key] = true
+	return true
+}
+
+func releasePartial(key string) {
+	activePartials.Lock()
+	defer activePartials.Unlock()
+	delete(activePartials.m, key)
+}
+
+// partialKey names the partial file of an upload. The same client sending
+// the same name and size continues it; anything else starts afresh. A
+// legacy upload can never be resumed, and having no client id it could
+// clash with another one of the same name and size, so it gets a key of
+// its own.
+func partialKey(h protocol.UploadHeader) string {
+	if h.Version < protocol.VersionResume {
+		return "legacy-" + rand.Text()
+	}
+	sum := sha256.New()
+	fmt.Fprintf(sum, "%s\x00%s\x00%d", h.ClientID, h.Name, h.Size)
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+// sweepPartials removes the partial uploads last written before cutoff,
+// leaving alone those a connection is still working on.
+func sweepPartials(st storage.Storage, cutoff time.Time) {
+	partials, err := st.Partials()
+	if err != nil {
+		log.Printf("cannot list partial uploads: %v", err)
+		return
+	}
+	for _, p := range partials {
+		if !p.ModTime.Before(cutoff) || !claimPartial(p.Name) {
+			continue
+		}
+		if err := st.Abort(p.Name); err != nil {
+			log.Printf("cannot remove partial upload %s: %v", p.Name, err)
+		} else {
+			log.Printf("removed partial upload %s (%d bytes), untouched since %s", p.Name, p.Size, p.ModTime.Format(time.RFC3339))
+		}
+		releasePartial(p.Name)
+	}
+}
+
+// openStorage opens the store selected by -storage.
+func openStorage(kind, dir string) (storage.Storage, error) {
+	switch kind {
+	case "fs":
+		return storage.NewFS(dir)
+	case "cas":
+		return storage.NewCAS(dir)
+	case "memory":
+		return storage.NewMemory(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage %q, want fs, cas or memory", kind)
+	}
 }
 
 func main() {
 	flag.Parse()
 
+	var err error
+	if onConflict, err = storage.ParsePolicy(*conflict); err != nil {
+		log.Fatal(err)
+	}
+
 	go func() {
 		http.Handle("/metrics", promhttp.Handler())
 		addr := fmt.Sprintf(":%d", *metricsPort)
@@ -60,9 +180,23 @@ func main() {
 		}
 	}()
 
-	uploadDir := "uploads"
-	if err := os.MkdirAll(uploadDir, 0755); err != nil {
-		log.Fatalf("cannot create uploads dir: %v", err)
+	st, err := openStorage(*backend, *storageRoot)
+	if err != nil {
+		log.Fatalf("cannot open storage: %v", err)
+	}
+	defer st.Close()
+	if *backend == "memory" {
+		log.Printf("storing uploads in memory")
+	} else {
+		log.Printf("storing uploads in %s (%s)", *storageRoot, *backend)
+	}
+	if *partialAge > 0 {
+		go func() {
+			for {
+				sweepPartials(st, time.Now().Add(-*partialAge))
+				time.Sleep(min(*partialAge/4, time.Hour))
+			}
+		}()
 	}
 
 	addr := fmt.Sprintf(":%d", *port)
@@ -71,7 +205,24 @@ func main() {
 		log.Fatalf("failed to listen on %s: %v", addr, err)
 	}
 	defer listener.Close()
-	log.Printf("server listening on %s", addr)
+
+	switch {
+	case *tlsCert != "" || *tlsKey != "":
+		cfg, err := serverTLSConfig(*tlsCert, *tlsKey, *clientCA)
+		if err != nil {
+			log.Fatalf("TLS setup failed: %v", err)
+		}
+		listener = tls.NewListener(listener, cfg)
+		if *clientCA != "" {
+			log.Printf("server listening on %s (mutual TLS)", addr)
+		} else {
+			log.Printf("server listening on %s (TLS)", addr)
+		}
+	case *clientCA != "":
+		log.Fatalf("-client-ca needs -tls-cert and -tls-key")
+	default:
+		log.Printf("server listening on %s", addr)
+	}
 
 	var wg sync.WaitGroup
 
@@ -84,46 +235,107 @@ func main() {
 		wg.Add(1)
 		go func(c net.Conn) {
 			defer wg.Done()
-			handleConnection(c, uploadDir)
+			handleConnection(c, st)
 		}(conn)
 	}
 }
 
-func handleConnection(conn net.Conn, uploadDir string) {
+func handleConnection(conn net.Conn, st storage.Storage) {
 	defer conn.Close()
 
 	activeConnections.Inc()
 	defer activeConnections.Dec()
 
+	client, err := clientIdentity(conn, 10*time.Second)
+	if err != nil {
+		log.Printf("[%s] %v", conn.RemoteAddr(), err)
+		return
+	}
+
 	r := bufio.NewReader(conn)
 
-	var nameLen uint16
-	if err := binary.Read(r, binary.BigEndian, &nameLen); err != nil {
-		log.Printf("[%s] failed to read name length: %v", conn.RemoteAddr(), err)
+	hdr, err := protocol.ReadUploadHeader(r)
+	if err != nil {
+		log.Printf("[%s] failed to read header: %v", conn.RemoteAddr(), err)
+		return
+	}
+	if hdr.Version >= protocol.VersionOps {
+		serveOps(conn, r, st, client, hdr)
+		log.Printf("[%s] connection closed", conn.RemoteAddr())
 		return
 	}
-	nameBytes := make([]byte, nameLen)
-	if _, err := io.ReadFull(r, nameBytes); err != nil {
-		log.Printf("[%s] failed to read filename: %v", conn.RemoteAddr(), err)
+	requests.WithLabelValues(protocol.OpPut.String()).Inc()
+	if hdr.Version >= protocol.VersionBatch {
+		receiveBatch(conn, r, st, client, hdr)
+		log.Printf("[%s] connection closed", conn.RemoteAddr())
 		return
 	}
-	filename := string(nameBytes)
-	safeName := filepath.Base(filename)
+	filename := hdr.Name
+	dst := filepath.Base(filename)
 
-	var fileSize uint64
-	if err := binary.Read(r, binary.BigEndian, &fileSize); err != nil {
-		log.Printf("[%s] failed to read file size: %v", conn.RemoteAddr(), err)
+	key := partialKey(hdr)
+	if !claimPartial(key) {
+		log.Printf("[%s] %q is already being uploaded", conn.RemoteAddr(), filename)
+		conn.Write([]byte{protocol.StatusFailed})
 		return
 	}
+	defer releasePartial(key)
 
-	dstPath := filepath.Join(uploadDir, safeName)
-	f, err := os.Create(dstPath)
+	// receiveFile has logged the outcome.
+	resp, _, _ := receiveFile(conn, r, st, client, hdr, key, dst, nil)
+	if _, err := conn.Write([]byte{resp}); err != nil {
+		log.Printf("[%s] failed to send response: %v", conn.RemoteAddr(), err)
+	}
+	log.Printf("[%s] connection closed", conn.RemoteAddr())
+}
+
+// receiveFile stores the body of the upload described by hdr as dst, a
+// name in st, and returns the status for the client together with the
+// name the file was stored under. The caller must hold the claim on key,
+// the upload's partial file. An error means the connection broke and nothing
+// more can be read from it. For batch entries e carries the permissions
+// and modification time to restore.
+func receiveFile(conn net.Conn, r *bufio.Reader, st storage.Storage, client string, hdr protocol.UploadHeader, key, dst string, e *protocol.Entry) (byte, string, error) {
+	filename := hdr.Name
+	fileSize := hdr.Size
+	resumable := hdr.Version >= protocol.VersionResume
+
+	f, err := st.Create(key)
 	if err != nil {
-		log.Printf("[%s] cannot create file %q: %v", conn.RemoteAddr(), dstPath, err)
-		return
+		log.Printf("[%s] cannot create partial upload of %q: %v", conn.RemoteAddr(), filename, err)
+		return protocol.StatusFailed, "", err
 	}
 	defer f.Close()
 
+	// Legacy clients always send the whole file.
+	var offset uint64
+	if resumable && uint64(f.Size()) <= fileSize {
+		offset = uint64(f.Size())
+	}
+	if err := f.Truncate(int64(offset)); err != nil {
+		log.Printf("[%s] cannot truncate partial upload of %q: %v", conn.RemoteAddr(), filename, err)
+		return protocol.StatusFailed, "", err
+	}
+	// The digest covers the whole file, so a resumed upload first hashes
+	// what is already stored.
+	h := hdr.HashAlg.New()
+	if h != nil && offset > 0 {
+		if _, err := io.Copy(h, io.NewSectionReader(f, 0, int64(offset))); err != nil {
+			log.Printf("[%s] cannot hash partial upload of %q: %v", conn.RemoteAddr(), filename, err)
+			return protocol.StatusFailed, "", err
+		}
+	}
+	if resumable {
+		if err := protocol.WriteOffset(conn, offset); err != nil {
+			log.Printf("[%s] failed to send offset: %v", conn.RemoteAddr(), err)
+			return protocol.StatusFailed, "", err
+		}
+		if offset > 0 {
+			resumedTransfers.Inc()
+			log.Printf("[%s] resuming %q at %d of %d bytes", conn.RemoteAddr(), filename, offset, fileSize)
+		}
+	}
+
 	var totalRead uint64
 	start := time.Now()
 	lastTime := start
@@ -166,63 +378,98 @@ func handleConnection(conn net.Conn, uploadDir string) {
 		}
 	}()
 
-	success := true
-	left := fileSize
+	// After a write error the rest of the body is still read, and dropped,
+	// so that the next batch entry starts where the client expects.
+	var readErr, writeErr error
+	left := fileSize - offset
 	buf := make([]byte, 32*1024)
 	for left > 0 {
-		n, err := r.Read(buf)
+		// Never read past the body, a trailer may follow.
+		n, err := r.Read(buf[:min(uint64(len(buf)), left)])
 		if n > 0 {
-			toWrite := n
-			if uint64(toWrite) > left {
-				toWrite = int(left)
-			}
-			if wn, werr := f.Write(buf[:toWrite]); werr != nil {
-				log.Printf("[%s] write error: %v", conn.RemoteAddr(), werr)
-				success = false
-				break
-			} else {
-				atomic.AddUint64(&totalRead, uint64(wn))
-				bytesReceived.Add(float64(wn))
-				left -= uint64(wn)
+			if writeErr == nil {
+				if _, writeErr = f.Write(buf[:n]); writeErr != nil {
+					log.Printf("[%s] write error: %v", conn.RemoteAddr(), writeErr)
+				} else if h != nil {
+					h.Write(buf[:n])
+				}
 			}
+			atomic.AddUint64(&totalRead, uint64(n))
+			bytesReceived.WithLabelValues(client).Add(float64(n))
+			left -= uint64(n)
 		}
-		if err != nil {
-			if err == io.EOF && left == 0 {
-				break
-			}
+		if err != nil && left > 0 {
 			log.Printf("[%s] read error: %v", conn.RemoteAddr(), err)
-			success = false
+			readErr = err
 			break
 		}
 	}
 
 	ticker.Stop()
 	close(done)
+	transferDuration.Observe(time.Since(start).Seconds())
 
-	if success && atomic.LoadUint64(&totalRead) != fileSize {
-		log.Printf("[%s] size mismatch: expected %d, got %d", conn.RemoteAddr(), fileSize, atomic.LoadUint64(&totalRead))
-		success = false
+	if readErr != nil {
+		log.Printf("[%s] failed to receive %q", conn.RemoteAddr(), filename)
+		if !resumable {
+			// Nobody can continue a legacy upload.
+			st.Abort(key)
+		}
+		return protocol.StatusFailed, "", readErr
 	}
-
-	duration := time.Since(start).Seconds()
-	transferDuration.Observe(duration)
-	if success {
-		fileTransfers.Inc()
-		log.Printf("[%s] received %q (%d bytes) → %s", conn.RemoteAddr(), filename, fileSize, dstPath)
-	} else {
+	var want []byte
+	if h != nil {
+		if want, err = protocol.ReadTrailer(r); err != nil {
+			log.Printf("[%s] failed to read checksum: %v", conn.RemoteAddr(), err)
+			return protocol.StatusFailed, "", err
+		}
+	}
+	if writeErr != nil {
+		st.Abort(key)
 		log.Printf("[%s] failed to receive %q", conn.RemoteAddr(), filename)
+		return protocol.StatusFailed, "", nil
 	}
 
-	var resp byte
-	if success {
-		log.Printf("[%s] received %q (%d bytes) → %s", conn.RemoteAddr(), filename, fileSize, dstPath)
-		resp = 1
-	} else {
+	var sum string
+	if h != nil {
+		got := h.Sum(nil)
+		sum = hex.EncodeToString(got)
+		if !bytes.Equal(want, got) {
+			log.Printf("[%s] %s mismatch for %q: client %x, received %s", conn.RemoteAddr(), hdr.HashAlg, filename, want, sum)
+			checksumVerifications.WithLabelValues(hdr.HashAlg.String(), "mismatch").Inc()
+			// A corrupted upload must start over.
+			st.Abort(key)
+			return protocol.StatusChecksumMismatch, "", nil
+		}
+		checksumVerifications.WithLabelValues(hdr.HashAlg.String(), "match").Inc()
+	}
+	var meta storage.Meta
+	if e != nil {
+		meta = storage.Meta{Perm: e.Perm(), ModTime: e.MTime}
+	}
+	if err := f.Close(); err != nil {
+		log.Printf("[%s] cannot close partial upload of %q: %v", conn.RemoteAddr(), filename, err)
+		return protocol.StatusFailed, "", nil
+	}
+	stored, err := commit(st, key, dst, meta)
+	if errors.Is(err, storage.ErrExists) {
+		log.Printf("[%s] refused %q: %s already exists", conn.RemoteAddr(), filename, dst)
+		st.Abort(key)
+		return protocol.StatusExists, "", nil
+	}
+	if err != nil {
+		log.Printf("[%s] cannot store %q as %s: %v", conn.RemoteAddr(), filename, dst, err)
+		if !resumable {
+			st.Abort(key)
+		}
 		log.Printf("[%s] failed to receive %q", conn.RemoteAddr(), filename)
-		resp = 0
+		return protocol.StatusFailed, "", nil
 	}
-	if _, err := conn.Write([]byte{resp}); err != nil {
-		log.Printf("[%s] failed to send response: %v", conn.RemoteAddr(), err)
+
+	fileTransfers.WithLabelValues(client).Inc()
+	log.Printf("[%s] received %q (%d bytes) → %s from %s", conn.RemoteAddr(), filename, fileSize, stored, client)
+	if h != nil {
+		log.Printf("[%s] %s %s %s", conn.RemoteAddr(), hdr.HashAlg, sum, stored)
 	}
-	log.Printf("[%s] connection closed", conn.RemoteAddr())
+	return protocol.StatusOK, stored, nil
 }
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/fs"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"networks_nsu/lab2/protocol"
+	"networks_nsu/lab2/storage"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+// issue creates a certificate for cn signed by parent, or a self-signed CA
+// when parent is nil.
+func issue(t *testing.T, cn string, parent *testCert, ips ...net.IP) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn, Organization: []string{"lab2 test"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  ips,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// files writes the certificate and key as PEM files and returns their
+// paths.
+func (c *testCert) files(t *testing.T, dir, name string) (certFile, keyFile string) {
+	t.Helper()
+	der, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+	if err := os.WriteFile(certFile, c.pem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func (c *testCert) tlsCert() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+// serve accepts connections on ln, storing uploads in memory, and returns
+// the store.
+func serve(t *testing.T, ln net.Listener) storage.Storage {
+	t.Helper()
+	st := storage.NewMemory()
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handleConnection(conn, st)
+		}
+	}()
+	return st
+}
+
+// readStored returns the content of a stored file.
+func readStored(st storage.Storage, name string) ([]byte, error) {
+	f, _, err := st.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// startServer serves uploads over mutual TLS and returns the address and
+// the store.
+func startServer(t *testing.T, ca *testCert) (string, storage.Storage) {
+	t.Helper()
+	dir := t.TempDir()
+	certFile, keyFile := issue(t, "server", ca, net.IPv4(127, 0, 0, 1)).files(t, dir, "server")
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caFile, ca.pem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := serverTLSConfig(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ln.Addr().String(), serve(t, ln)
+}
+
+// send uploads data as name and returns the server's status.
+func send(addr string, cfg *tls.Config, name string, data []byte) (byte, error) {
+	conn, err := tls.Dial("tcp", addr, cfg)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	sum := sha256.Sum256(data)
+	return upload(conn, protocol.UploadHeader{
+		Version:  protocol.VersionChecksum,
+		ClientID: "test",
+		Name:     name,
+		Size:     uint64(len(data)),
+		HashAlg:  protocol.HashSHA256,
+	}, data, sum[:])
+}
+
+// upload sends data under hdr, from the offset the server asks for, with
+// sum as the trailer when hdr names a hash, and returns the server's
+// status.
+func upload(conn net.Conn, hdr protocol.UploadHeader, data, sum []byte) (byte, error) {
+	if err := hdr.Write(conn); err != nil {
+		return 0, err
+	}
+	if hdr.Version >= protocol.VersionResume {
+		offset, err := protocol.ReadOffset(conn)
+		if err != nil {
+			return 0, err
+		}
+		data = data[offset:]
+	}
+	if _, err := conn.Write(data); err != nil {
+		return 0, err
+	}
+	if hdr.HashAlg != protocol.HashNone {
+		if err := protocol.WriteTrailer(conn, sum); err != nil {
+			return 0, err
+		}
+	}
+	var status [1]byte
+	_, err := io.ReadFull(conn, status[:])
+	return status[0], err
+}
+
+func metricValue(t *testing.T, c prometheus.Counter) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func counterValue(t *testing.T, client string) float64 {
+	t.Helper()
+	return metricValue(t, fileTransfers.WithLabelValues(client))
+}
+
+func TestMutualTLSUpload(t *testing.T) {
+	ca := issue(t, "test CA", nil)
+	addr, st := startServer(t, ca)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	client := issue(t, "alice", ca)
+	subject := client.cert.Subject.String()
+	before := counterValue(t, subject)
+
+	data := bytes.Repeat([]byte("secret contents "), 4096)
+	status, err := send(addr, &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{client.tlsCert()}}, "notes.txt", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != protocol.StatusOK {
+		t.Fatalf("status = %d, want %d", status, protocol.StatusOK)
+	}
+	got, err := readStored(st, "notes.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("stored file differs from the upload")
+	}
+	if after := counterValue(t, subject); after != before+1 {
+		t.Errorf("transfers for %q = %v, want %v", subject, after, before+1)
+	}
+}
+
+func TestMutualTLSRejectsUnknownClients(t *testing.T) {
+	ca := issue(t, "test CA", nil)
+	addr, st := startServer(t, ca)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	stranger := issue(t, "mallory", issue(t, "other CA", nil))
+
+	for name, cfg := range map[string]*tls.Config{
+		"no certificate":    {RootCAs: roots},
+		"foreign authority": {RootCAs: roots, Certificates: []tls.Certificate{stranger.tlsCert()}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := send(addr, cfg, "x.txt", []byte("x")); err == nil {
+				t.Fatal("upload succeeded without a trusted client certificate")
+			}
+		})
+	}
+	if _, err := st.Stat("x.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("rejected upload was stored: %v", err)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	data := bytes.Repeat([]byte("checked contents "), 1000)
+	for _, alg := range []protocol.HashAlg{protocol.HashSHA256, protocol.HashXXH64} {
+		t.Run(alg.String(), func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			st := serve(t, ln)
+			h := alg.New()
+			h.Write(data)
+			good := h.Sum(nil)
+			bad := bytes.Clone(good)
+			bad[0] ^= 1
+
+			for _, tc := range []struct {
+				name    string
+				sum     []byte
+				status  byte
+				outcome string
+			}{
+				{"good.txt", good, protocol.StatusOK, "match"},
+				{"bad.txt", bad, protocol.StatusChecksumMismatch, "mismatch"},
+			} {
+				verified := checksumVerifications.WithLabelValues(alg.String(), tc.outcome)
+				before := metricValue(t, verified)
+				conn, err := net.Dial("tcp", ln.Addr().String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				status, err := upload(conn, protocol.UploadHeader{
+					Version:  protocol.VersionChecksum,
+					ClientID: "test",
+					Name:     tc.name,
+					Size:     uint64(len(data)),
+					HashAlg:  alg,
+				}, data, tc.sum)
+				conn.Close()
+				if err != nil || status != tc.status {
+					t.Errorf("%s: status %d, %v; want %d", tc.name, status, err, tc.status)
+				}
+				if after := metricValue(t, verified); after != before+1 {
+					t.Errorf("%s: %s verifications went from %v to %v", tc.name, tc.outcome, before, after)
+				}
+			}
+			if got, err := readStored(st, "good.txt"); err != nil || !bytes.Equal(got, data) {
+				t.Errorf("good.txt stored as %d bytes, %v", len(got), err)
+			}
+			if _, err := st.Stat("bad.txt"); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("upload with a wrong checksum was stored: %v", err)
+			}
+		})
+	}
+}
+
+// TestResume drops the connection in the middle of an upload and checks
+// that the next attempt continues where the server stopped.
+func TestResume(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := serve(t, ln)
+	data := bytes.Repeat([]byte("resumable contents "), 4096)
+	half := len(data) / 2
+	sum := sha256.Sum256(data)
+	hdr := protocol.UploadHeader{
+		Version:  protocol.VersionChecksum,
+		ClientID: "test",
+		Name:     "big.txt",
+		Size:     uint64(len(data)),
+		HashAlg:  protocol.HashSHA256,
+	}
+	resumed := metricValue(t, resumedTransfers)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hdr.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	if offset, err := protocol.ReadOffset(conn); err != nil || offset != 0 {
+		t.Fatalf("first offset %d, %v", offset, err)
+	}
+	if _, err := conn.Write(data[:half]); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// The server may not have noticed the broken connection yet, in which
+	// case it refuses the second one instead of sending an offset.
+	var offset uint64
+	for attempt := 0; ; attempt++ {
+		if conn, err = net.Dial("tcp", ln.Addr().String()); err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if err := hdr.Write(conn); err != nil {
+			t.Fatal(err)
+		}
+		if offset, err = protocol.ReadOffset(conn); err == nil {
+			break
+		}
+		if attempt == 50 {
+			t.Fatalf("no offset after %d attempts: %v", attempt, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if offset != uint64(half) {
+		t.Fatalf("resuming at %d, want %d", offset, half)
+	}
+	if _, err := conn.Write(data[offset:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := protocol.WriteTrailer(conn, sum[:]); err != nil {
+		t.Fatal(err)
+	}
+	var status [1]byte
+	if _, err := io.ReadFull(conn, status[:]); err != nil || status[0] != protocol.StatusOK {
+		t.Fatalf("status %d, %v", status[0], err)
+	}
+	if got, err := readStored(st, "big.txt"); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("stored %d of %d bytes, %v", len(got), len(data), err)
+	}
+	if after := metricValue(t, resumedTransfers); after != resumed+1 {
+		t.Errorf("resumed transfers went from %v to %v", resumed, after)
+	}
+}
+
+// TestLegacyUpload uploads as a client that predates the extended header:
+// no offset, no checksum, and only the base name of the path is kept.
+func TestLegacyUpload(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := serve(t, ln)
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	data := []byte("legacy contents")
+	status, err := upload(conn, protocol.UploadHeader{
+		Version: protocol.VersionLegacy,
+		Name:    "some/dir/old.txt",
+		Size:    uint64(len(data)),
+	}, data, nil)
+	if err != nil || status != protocol.StatusOK {
+		t.Fatalf("status %d, %v", status, err)
+	}
+	if got, err := readStored(st, "old.txt"); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("old.txt = %q, %v", got, err)
+	}
+}
+
+// TestConcurrentLegacyUploads sends two legacy uploads of the same name
+// and size at once; without a client id they must still not share a
+// partial file.
+func TestConcurrentLegacyUploads(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := serve(t, ln)
+	hdr := protocol.UploadHeader{Version: protocol.VersionLegacy, Name: "same.txt", Size: 8}
+	var conns [2]net.Conn
+	for i := range conns {
+		if conns[i], err = net.Dial("tcp", ln.Addr().String()); err != nil {
+			t.Fatal(err)
+		}
+		defer conns[i].Close()
+		if err := hdr.Write(conns[i]); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conns[i].Write([]byte("1234")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, conn := range conns {
+		if _, err := conn.Write([]byte("abcd")); err != nil {
+			t.Fatal(err)
+		}
+		var status [1]byte
+		if _, err := io.ReadFull(conn, status[:]); err != nil || status[0] != protocol.StatusOK {
+			t.Errorf("upload %d: status %d, %v", i+1, status[0], err)
+		}
+	}
+	if got, err := readStored(st, "same.txt"); err != nil || string(got) != "1234abcd" {
+		t.Errorf("same.txt = %q, %v", got, err)
+	}
+	if l, err := st.Partials(); err != nil || len(l) != 0 {
+		t.Errorf("partial uploads left behind: %+v, %v", l, err)
+	}
+}
+
+func TestSweepPartials(t *testing.T) {
+	st := storage.NewMemory()
+	for _, key := range []string{"abandoned", "busy"} {
+		p, err := st.Create(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Write([]byte(key))
+		p.Close()
+	}
+	keys := func() []string {
+		l, err := st.Partials()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		for _, i := range l {
+			keys = append(keys, i.Name)
+		}
+		return keys
+	}
+
+	sweepPartials(st, time.Now().Add(-time.Hour))
+	if k := keys(); len(k) != 2 {
+		t.Fatalf("recent partial uploads swept, left %q", k)
+	}
+	if !claimPartial("busy") {
+		t.Fatal("cannot claim busy")
+	}
+	defer releasePartial("busy")
+	sweepPartials(st, time.Now().Add(time.Second))
+	if k := keys(); len(k) != 1 || k[0] != "busy" {
+		t.Errorf("left %q, want only the upload in progress", k)
+	}
+}
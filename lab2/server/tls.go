@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// anonymousClient labels transfers from clients that did not present a
+// certificate.
+const anonymousClient = "anonymous"
+
+// serverTLSConfig loads the server certificate and, when caFile is set,
+// requires clients to present a certificate signed by that CA.
+func serverTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load server certificate: %w", err)
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read CA bundle: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %q", path)
+	}
+	return pool, nil
+}
+
+// clientIdentity completes the TLS handshake, if conn is a TLS connection,
+// and returns the subject of the client certificate.
+func clientIdentity(conn net.Conn, timeout time.Duration) (string, error) {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return anonymousClient, nil
+	}
+	tc.SetDeadline(time.Now().Add(timeout))
+	defer tc.SetDeadline(time.Time{})
+	if err := tc.Handshake(); err != nil {
+		return "", fmt.Errorf("tls handshake: %w", err)
+	}
+	certs := tc.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return anonymousClient, nil
+	}
+	subject := certs[0].Subject.String()
+	if subject == "" {
+		return "", errors.New("client certificate has an empty subject")
+	}
+	return subject, nil
+}
@@ -0,0 +1,238 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// CAS is a content-addressed store: the content of every file is kept once
+// under objects/ by its SHA-256, however many names it is uploaded under,
+// and index.json maps the names to it. An object goes away with the last
+// name using it.
+type CAS struct {
+	dir string
+
+	// mu guards files and index.json, and orders the objects coming and
+	// going with the names that use them.
+	mu    sync.Mutex
+	files tree
+}
+
+const (
+	casObjects  = "objects"
+	casPartials = "partial"
+	casIndex    = "index.json"
+)
+
+func NewCAS(dir string) (*CAS, error) {
+	for _, sub := range []string{casObjects, casPartials} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+	s := &CAS{dir: dir, files: make(tree)}
+	b, err := os.ReadFile(filepath.Join(dir, casIndex))
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(b, &s.files); err != nil {
+			return nil, fmt.Errorf("corrupt %s: %w", casIndex, err)
+		}
+	}
+	return s, nil
+}
+
+func (s *CAS) Close() error { return nil }
+
+func (s *CAS) partialPath(key string) string { return filepath.Join(s.dir, casPartials, key) }
+
+func (s *CAS) objectPath(hash string) string { return filepath.Join(s.dir, casObjects, hash) }
+
+func (s *CAS) Create(key string) (Partial, error) {
+	if err := cleanKey(key); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(s.partialPath(key), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &filePartial{File: f, size: size}, nil
+}
+
+// Commit turns the partial file into the object of its content, or drops
+// it when the object is already there.
+func (s *CAS) Commit(key, name string, meta Meta, policy Policy) (string, error) {
+	if err := cleanKey(key); err != nil {
+		return "", err
+	}
+	part := s.partialPath(key)
+	hash, size, err := hashFile(part)
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name, old, err := s.files.place(name, policy)
+	if err != nil {
+		return "", err
+	}
+	obj := s.objectPath(hash)
+	if _, err := os.Stat(obj); err == nil {
+		os.Remove(part)
+	} else if err := os.Rename(part, obj); err != nil {
+		return "", err
+	}
+	s.files[name] = &node{Mode: meta.perm(), Size: size, ModTime: meta.modTime(), Hash: hash}
+	if err := s.save(); err != nil {
+		// The upload is gone either way; leave the index as it was.
+		if old != nil {
+			s.files[name] = old
+		} else {
+			delete(s.files, name)
+		}
+		s.collect(hash)
+		return "", err
+	}
+	if old != nil {
+		s.collect(old.Hash)
+	}
+	return name, nil
+}
+
+func hashFile(name string) (string, int64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// save writes the index through a temporary file, so that a crash leaves
+// the old or the new one.
+func (s *CAS) save() error {
+	b, err := json.Marshal(s.files)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(s.dir, casIndex+".tmp")
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.dir, casIndex))
+}
+
+// collect removes the object hash once no name uses it.
+func (s *CAS) collect(hash string) {
+	for _, n := range s.files {
+		if n.Hash == hash {
+			return
+		}
+	}
+	os.Remove(s.objectPath(hash))
+}
+
+func (s *CAS) Abort(key string) error {
+	if err := cleanKey(key); err != nil {
+		return err
+	}
+	err := os.Remove(s.partialPath(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (s *CAS) Partials() ([]Info, error) {
+	entries, err := os.ReadDir(filepath.Join(s.dir, casPartials))
+	if err != nil {
+		return nil, err
+	}
+	return partialInfos(entries)
+}
+
+func (s *CAS) Stat(name string) (Info, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.files.stat(name)
+}
+
+func (s *CAS) List(name string) ([]Info, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.files.list(name)
+}
+
+func (s *CAS) Open(name string) (io.ReadCloser, Info, error) {
+	if _, err := CleanName(name); err != nil {
+		return nil, Info{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name, n, err := s.files.lookup("open", name)
+	if err != nil {
+		return nil, Info{}, err
+	}
+	if n.Mode.IsDir() {
+		return nil, Info{}, &fs.PathError{Op: "open", Path: name, Err: ErrIsDir}
+	}
+	// Once open the object can be read to the end even if its last name
+	// is removed meanwhile.
+	f, err := os.Open(s.objectPath(n.Hash))
+	if err != nil {
+		return nil, Info{}, err
+	}
+	return f, n.info(name), nil
+}
+
+func (s *CAS) Mkdir(name string, perm fs.FileMode) error {
+	name, err := CleanName(name)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, existed := s.files[name]
+	if err := s.files.mkdirAll(name, perm); err != nil || existed {
+		return err
+	}
+	return s.save()
+}
+
+func (s *CAS) Remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name, n, err := s.files.remove(name)
+	if err != nil {
+		return err
+	}
+	if err := s.save(); err != nil {
+		s.files[name] = n
+		return err
+	}
+	if !n.Mode.IsDir() {
+		s.collect(n.Hash)
+	}
+	return nil
+}
@@ -0,0 +1,270 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+// FS stores files as they are named in a directory, with partial uploads in
+// its PartialDir. Everything goes through an os.Root, so symlinks in the
+// directory cannot lead out of it.
+type FS struct {
+	root *os.Root
+}
+
+func NewFS(dir string) (*FS, error) {
+	if err := os.MkdirAll(filepath.Join(dir, PartialDir), 0755); err != nil {
+		return nil, err
+	}
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &FS{root: root}, nil
+}
+
+func (s *FS) Close() error { return s.root.Close() }
+
+func partialPath(key string) string { return filepath.Join(PartialDir, key) }
+
+type filePartial struct {
+	*os.File
+	size int64
+}
+
+func (p *filePartial) Size() int64 { return p.size }
+
+func (p *filePartial) Truncate(size int64) error {
+	if err := p.File.Truncate(size); err != nil {
+		return err
+	}
+	if _, err := p.Seek(size, io.SeekStart); err != nil {
+		return err
+	}
+	p.size = size
+	return nil
+}
+
+func (p *filePartial) Write(b []byte) (int, error) {
+	n, err := p.File.Write(b)
+	p.size += int64(n)
+	return n, err
+}
+
+func (s *FS) Create(key string) (Partial, error) {
+	if err := cleanKey(key); err != nil {
+		return nil, err
+	}
+	f, err := s.root.OpenFile(partialPath(key), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &filePartial{File: f, size: size}, nil
+}
+
+// Commit moves the partial file into place. Under Overwrite that is a
+// rename, under Rename and Reject a link, which unlike a rename never
+// replaces an existing file. Either way readers see the old file or the
+// complete new one, and of two uploads finishing at once under Rename or
+// Reject only one gets a name.
+func (s *FS) Commit(key, name string, meta Meta, policy Policy) (string, error) {
+	if err := cleanKey(key); err != nil {
+		return "", err
+	}
+	name, err := CleanName(name)
+	if err != nil {
+		return "", err
+	}
+	part := partialPath(key)
+	if err := s.root.Chmod(part, meta.perm()); err != nil {
+		return "", err
+	}
+	if err := s.root.MkdirAll(filepath.FromSlash(path.Dir(name)), 0755); err != nil {
+		return "", err
+	}
+
+	stored := name
+	if policy == Overwrite {
+		err = s.root.Rename(part, filepath.FromSlash(name))
+	} else {
+		stored, err = s.link(part, name, policy)
+		if err == nil {
+			s.root.Remove(part)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	mtime := meta.modTime()
+	return stored, s.root.Chtimes(filepath.FromSlash(stored), mtime, mtime)
+}
+
+func (s *FS) link(part, name string, policy Policy) (string, error) {
+	for i := 0; i < maxRenames; i++ {
+		n := Suffixed(name, i)
+		err := s.root.Link(part, filepath.FromSlash(n))
+		if err == nil {
+			return n, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return "", err
+		}
+		if policy == Reject {
+			return "", ErrExists
+		}
+	}
+	return "", fmt.Errorf("no free name for %q after %d tries", name, maxRenames)
+}
+
+func (s *FS) Abort(key string) error {
+	if err := cleanKey(key); err != nil {
+		return err
+	}
+	err := s.root.Remove(partialPath(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (s *FS) Partials() ([]Info, error) {
+	entries, err := fs.ReadDir(s.root.FS(), PartialDir)
+	if err != nil {
+		return nil, err
+	}
+	return partialInfos(entries)
+}
+
+// partialInfos describes the partial files in a directory listing.
+func partialInfos(entries []fs.DirEntry) ([]Info, error) {
+	var infos []Info
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		fi, err := e.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			// Committed or aborted since the directory was read.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, fileInfo(e.Name(), fi))
+	}
+	return infos, nil
+}
+
+// lookup resolves name, with "" standing for the directory itself.
+func (s *FS) lookup(name string) (string, error) {
+	if name == "" {
+		return ".", nil
+	}
+	return CleanName(name)
+}
+
+func fileInfo(name string, fi fs.FileInfo) Info {
+	i := Info{Name: name, Mode: fi.Mode() & (fs.ModeType | fs.ModePerm), ModTime: fi.ModTime()}
+	if !fi.IsDir() {
+		i.Size = fi.Size()
+	}
+	return i
+}
+
+func (s *FS) Stat(name string) (Info, error) {
+	name, err := s.lookup(name)
+	if err != nil {
+		return Info{}, err
+	}
+	fi, err := s.root.Stat(filepath.FromSlash(name))
+	if err != nil {
+		return Info{}, err
+	}
+	if name == "." {
+		name = ""
+	}
+	return fileInfo(name, fi), nil
+}
+
+// List leaves out partial uploads and anything that is neither a regular
+// file nor a directory.
+func (s *FS) List(name string) ([]Info, error) {
+	start, err := s.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	var infos []Info
+	err = fs.WalkDir(s.root.FS(), start, func(p string, d fs.DirEntry, err error) error {
+		switch {
+		case err != nil:
+			return err
+		case p == start && d.IsDir():
+			return nil
+		case p == PartialDir:
+			return fs.SkipDir
+		case !d.IsDir() && !d.Type().IsRegular():
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		infos = append(infos, fileInfo(p, fi))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+func (s *FS) Open(name string) (io.ReadCloser, Info, error) {
+	name, err := CleanName(name)
+	if err != nil {
+		return nil, Info{}, err
+	}
+	f, err := s.root.Open(filepath.FromSlash(name))
+	if err != nil {
+		return nil, Info{}, err
+	}
+	fi, err := f.Stat()
+	if err == nil && !fi.Mode().IsRegular() {
+		err = ErrIsDir
+		if !fi.IsDir() {
+			err = errors.New("not a regular file")
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, Info{}, err
+	}
+	return f, fileInfo(name, fi), nil
+}
+
+func (s *FS) Mkdir(name string, perm fs.FileMode) error {
+	name, err := CleanName(name)
+	if err != nil {
+		return err
+	}
+	return s.root.MkdirAll(filepath.FromSlash(name), perm)
+}
+
+func (s *FS) Remove(name string) error {
+	name, err := CleanName(name)
+	if err != nil {
+		return err
+	}
+	return s.root.Remove(filepath.FromSlash(name))
+}
@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Memory keeps everything in memory and loses it on exit. It is meant for
+// tests.
+type Memory struct {
+	mu       sync.Mutex
+	partials map[string]*memPartial
+	files    tree
+}
+
+func NewMemory() *Memory {
+	return &Memory{partials: make(map[string]*memPartial), files: make(tree)}
+}
+
+func (s *Memory) Close() error { return nil }
+
+type memPartial struct {
+	s       *Memory
+	data    []byte
+	modTime time.Time
+}
+
+func (p *memPartial) Write(b []byte) (int, error) {
+	p.s.mu.Lock()
+	defer p.s.mu.Unlock()
+	p.data = append(p.data, b...)
+	p.modTime = time.Now()
+	return len(b), nil
+}
+
+func (p *memPartial) ReadAt(b []byte, off int64) (int, error) {
+	p.s.mu.Lock()
+	defer p.s.mu.Unlock()
+	return bytes.NewReader(p.data).ReadAt(b, off)
+}
+
+func (p *memPartial) Size() int64 {
+	p.s.mu.Lock()
+	defer p.s.mu.Unlock()
+	return int64(len(p.data))
+}
+
+func (p *memPartial) Truncate(size int64) error {
+	p.s.mu.Lock()
+	defer p.s.mu.Unlock()
+	if size < int64(len(p.data)) {
+		p.data = p.data[:size]
+	} else {
+		p.data = append(p.data, make([]byte, size-int64(len(p.data)))...)
+	}
+	p.modTime = time.Now()
+	return nil
+}
+
+func (p *memPartial) Close() error { return nil }
+
+func (s *Memory) Create(key string) (Partial, error) {
+	if err := cleanKey(key); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := s.partials[key]
+	if p == nil {
+		p = &memPartial{s: s, modTime: time.Now()}
+		s.partials[key] = p
+	}
+	return p, nil
+}
+
+func (s *Memory) Commit(key, name string, meta Meta, policy Policy) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := s.partials[key]
+	if p == nil {
+		return "", notExist("commit", key)
+	}
+	name, _, err := s.files.place(name, policy)
+	if err != nil {
+		return "", err
+	}
+	delete(s.partials, key)
+	s.files[name] = &node{Mode: meta.perm(), Size: int64(len(p.data)), ModTime: meta.modTime(), data: p.data}
+	return name, nil
+}
+
+func (s *Memory) Abort(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.partials, key)
+	return nil
+}
+
+func (s *Memory) Partials() ([]Info, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	infos := make([]Info, 0, len(s.partials))
+	for key, p := range s.partials {
+		infos = append(infos, Info{Name: key, Mode: 0644, Size: int64(len(p.data)), ModTime: p.modTime})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+func (s *Memory) Stat(name string) (Info, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.files.stat(name)
+}
+
+func (s *Memory) List(name string) ([]Info, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.files.list(name)
+}
+
+func (s *Memory) Open(name string) (io.ReadCloser, Info, error) {
+	if _, err := CleanName(name); err != nil {
+		return nil, Info{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name, n, err := s.files.lookup("open", name)
+	if err != nil {
+		return nil, Info{}, err
+	}
+	if n.Mode.IsDir() {
+		return nil, Info{}, &fs.PathError{Op: "open", Path: name, Err: ErrIsDir}
+	}
+	// Commits replace the node, so its data never changes underneath.
+	return io.NopCloser(bytes.NewReader(n.data)), n.info(name), nil
+}
+
+func (s *Memory) Mkdir(name string, perm fs.FileMode) error {
+	name, err := CleanName(name)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.files.mkdirAll(name, perm)
+}
+
+func (s *Memory) Remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, _, err := s.files.remove(name)
+	return err
+}
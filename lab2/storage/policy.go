@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Policy decides what Commit does when the name is already taken.
+type Policy int
+
+const (
+	Overwrite Policy = iota
+	// Rename stores the upload as name-1.ext, name-2.ext, ...
+	Rename
+	Reject
+)
+
+// maxRenames bounds the search for a free name.
+const maxRenames = 10000
+
+func ParsePolicy(s string) (Policy, error) {
+	switch s {
+	case "overwrite":
+		return Overwrite, nil
+	case "rename":
+		return Rename, nil
+	case "reject":
+		return Reject, nil
+	default:
+		return 0, fmt.Errorf("unknown conflict policy %q, want overwrite, rename or reject", s)
+	}
+}
+
+func (p Policy) String() string {
+	switch p {
+	case Rename:
+		return "rename"
+	case Reject:
+		return "reject"
+	default:
+		return "overwrite"
+	}
+}
+
+// pick returns the name a commit to name goes to, given what is taken. The
+// stores that keep names in memory call it under their lock.
+func (p Policy) pick(name string, taken func(string) bool) (string, error) {
+	if p == Overwrite {
+		return name, nil
+	}
+	for i := 0; i < maxRenames; i++ {
+		n := Suffixed(name, i)
+		if !taken(n) {
+			return n, nil
+		}
+		if p == Reject {
+			return "", ErrExists
+		}
+	}
+	return "", fmt.Errorf("no free name for %q after %d tries", name, maxRenames)
+}
+
+// Suffixed returns name with -i before its extension, or name for i == 0.
+func Suffixed(name string, i int) string {
+	if i == 0 {
+		return name
+	}
+	dir, base := path.Split(name)
+	ext := path.Ext(base)
+	if ext == base {
+		// A dotfile such as .profile has no extension.
+		ext = ""
+	}
+	return dir + fmt.Sprintf("%s-%d%s", strings.TrimSuffix(base, ext), i, ext)
+}
@@ -0,0 +1,126 @@
+// Package storage keeps the files received by the lab2 server.
+//
+// An upload is written to a partial file under a key chosen by the server,
+// which survives a broken connection so that the upload can be resumed, and
+// is then committed under its name or aborted. Names are slash-separated
+// and relative to the store, as in io/fs.
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// PartialDir is where the file system store keeps unfinished uploads; the
+// name is reserved in every store.
+const PartialDir = ".partial"
+
+var (
+	// ErrExists is returned by Commit under Reject when the name is taken.
+	ErrExists = errors.New("name is taken")
+	ErrIsDir  = errors.New("is a directory")
+)
+
+type Storage interface {
+	// Create opens the partial upload key, creating it if needed. What an
+	// earlier, interrupted upload left in it is kept and writes go after
+	// it.
+	Create(key string) (Partial, error)
+	// Commit stores the closed partial upload key as name, creating the
+	// directories above it, and returns the name it was stored under,
+	// which differs from name when the policy renamed it. On error the
+	// partial upload is left for the caller to Abort.
+	Commit(key, name string, meta Meta, policy Policy) (string, error)
+	// Abort throws the partial upload key away.
+	Abort(key string) error
+	// Partials lists the partial uploads, named by key, with the time each
+	// was last written.
+	Partials() ([]Info, error)
+
+	// List returns name and everything below it, or the whole store for
+	// "", sorted by name. A directory does not list itself.
+	List(name string) ([]Info, error)
+	// Open opens a stored file for reading.
+	Open(name string) (io.ReadCloser, Info, error)
+	Stat(name string) (Info, error)
+	// Mkdir creates a directory and any missing parents.
+	Mkdir(name string, perm fs.FileMode) error
+	// Remove deletes a file or an empty directory.
+	Remove(name string) error
+	Close() error
+}
+
+// Partial is an unfinished upload.
+type Partial interface {
+	io.Writer
+	// ReadAt reads back what is already written, e.g. to hash it.
+	io.ReaderAt
+	io.Closer
+	// Size is how much the upload holds.
+	Size() int64
+	// Truncate cuts the upload to size; later writes go after it.
+	Truncate(size int64) error
+}
+
+// Meta is what Commit records about a file besides its content.
+type Meta struct {
+	// Perm defaults to 0644.
+	Perm fs.FileMode
+	// ModTime defaults to the time of the commit.
+	ModTime time.Time
+}
+
+func (m Meta) perm() fs.FileMode {
+	if m.Perm == 0 {
+		return 0644
+	}
+	return m.Perm.Perm()
+}
+
+func (m Meta) modTime() time.Time {
+	if m.ModTime.IsZero() {
+		return time.Now()
+	}
+	return m.ModTime
+}
+
+type Info struct {
+	Name    string
+	Size    int64
+	Mode    fs.FileMode
+	ModTime time.Time
+}
+
+func (i Info) IsDir() bool { return i.Mode.IsDir() }
+
+// CleanName checks that name stays inside a store and returns it cleaned.
+// Absolute names, names leaving the store via "..", the store itself and
+// anything under PartialDir are refused.
+func CleanName(name string) (string, error) {
+	if !filepath.IsLocal(filepath.FromSlash(name)) {
+		return "", errors.New("path is not local to the store")
+	}
+	name = path.Clean(name)
+	if name == "." {
+		return "", errors.New("empty path")
+	}
+	if first, _, _ := strings.Cut(name, "/"); first == PartialDir {
+		return "", errors.New("path is reserved")
+	}
+	return name, nil
+}
+
+// cleanKey checks a partial upload key, which must be a single path
+// element.
+func cleanKey(key string) error {
+	if key == "" || strings.ContainsAny(key, `/\`) || key == "." || key == ".." {
+		return fmt.Errorf("bad upload key %q", key)
+	}
+	return nil
+}
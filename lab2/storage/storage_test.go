@@ -0,0 +1,351 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var backends = map[string]func(t *testing.T) Storage{
+	"fs": func(t *testing.T) Storage {
+		s, err := NewFS(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	},
+	"cas": func(t *testing.T) Storage {
+		s, err := NewCAS(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	},
+	"memory": func(t *testing.T) Storage { return NewMemory() },
+}
+
+// put uploads data under key, possibly in several pieces, and commits it.
+func put(t *testing.T, s Storage, key, name string, meta Meta, policy Policy, data ...string) (string, error) {
+	t.Helper()
+	for _, d := range data {
+		p, err := s.Create(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p.Write([]byte(d)); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s.Commit(key, name, meta, policy)
+}
+
+func content(t *testing.T, s Storage, name string) string {
+	t.Helper()
+	f, _, err := s.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func names(infos []Info) []string {
+	var n []string
+	for _, i := range infos {
+		n = append(n, i.Name)
+	}
+	return n
+}
+
+func TestStorage(t *testing.T) {
+	for backend, open := range backends {
+		t.Run(backend, func(t *testing.T) {
+			t.Run("resume", func(t *testing.T) {
+				s := open(t)
+				mtime := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+				// Each piece is written after reopening the partial upload.
+				stored, err := put(t, s, "k", "dir/sub/f.txt", Meta{Perm: 0600, ModTime: mtime}, Overwrite, "hello, ", "world")
+				if err != nil || stored != "dir/sub/f.txt" {
+					t.Fatalf("Commit = %q, %v", stored, err)
+				}
+				if got := content(t, s, "dir/sub/f.txt"); got != "hello, world" {
+					t.Errorf("content %q", got)
+				}
+				fi, err := s.Stat("dir/sub/f.txt")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if fi.Size != 12 || fi.Mode != 0600 || !fi.ModTime.Equal(mtime) {
+					t.Errorf("stored as %+v", fi)
+				}
+				if fi, err := s.Stat("dir/sub"); err != nil || !fi.IsDir() {
+					t.Errorf("parent %+v, %v", fi, err)
+				}
+				// The partial upload went with the commit.
+				p, err := s.Create("k")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer p.Close()
+				if p.Size() != 0 {
+					t.Errorf("partial upload still holds %d bytes", p.Size())
+				}
+			})
+
+			t.Run("truncate and abort", func(t *testing.T) {
+				s := open(t)
+				p, err := s.Create("k")
+				if err != nil {
+					t.Fatal(err)
+				}
+				p.Write([]byte("garbage"))
+				if err := p.Truncate(3); err != nil {
+					t.Fatal(err)
+				}
+				p.Write([]byte("bage"))
+				b := make([]byte, 7)
+				if _, err := p.ReadAt(b, 0); err != nil || string(b) != "garbage" {
+					t.Errorf("ReadAt = %q, %v", b, err)
+				}
+				p.Close()
+				if err := s.Abort("k"); err != nil {
+					t.Fatal(err)
+				}
+				if p, err = s.Create("k"); err != nil {
+					t.Fatal(err)
+				}
+				defer p.Close()
+				if p.Size() != 0 {
+					t.Errorf("aborted upload still holds %d bytes", p.Size())
+				}
+			})
+
+			t.Run("partials", func(t *testing.T) {
+				s := open(t)
+				before := time.Now().Add(-time.Second)
+				for _, k := range []string{"b", "a"} {
+					p, err := s.Create(k)
+					if err != nil {
+						t.Fatal(err)
+					}
+					p.Write([]byte("data of " + k))
+					p.Close()
+				}
+				if _, err := s.Commit("b", "b.txt", Meta{}, Overwrite); err != nil {
+					t.Fatal(err)
+				}
+				l, err := s.Partials()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(l) != 1 || l[0].Name != "a" || l[0].Size != 9 || l[0].ModTime.Before(before) {
+					t.Errorf("Partials = %+v, want a with 9 bytes written just now", l)
+				}
+			})
+
+			t.Run("policies", func(t *testing.T) {
+				s := open(t)
+				for i, d := range []string{"one", "two"} {
+					if _, err := put(t, s, "k", "r.txt", Meta{}, Overwrite, d); err != nil {
+						t.Fatalf("upload %d: %v", i, err)
+					}
+				}
+				if got := content(t, s, "r.txt"); got != "two" {
+					t.Errorf("overwritten with %q", got)
+				}
+				if stored, err := put(t, s, "k", "r.txt", Meta{}, Rename, "three"); err != nil || stored != "r-1.txt" {
+					t.Errorf("rename stored %q, %v", stored, err)
+				}
+				if _, err := put(t, s, "k", "r.txt", Meta{}, Reject, "four"); err != ErrExists {
+					t.Errorf("reject = %v, want %v", err, ErrExists)
+				}
+				s.Abort("k")
+				if got := content(t, s, "r.txt"); got != "two" {
+					t.Errorf("rejected upload replaced the file with %q", got)
+				}
+				if _, err := put(t, s, "k", "r.txt/x", Meta{}, Overwrite, "five"); err == nil {
+					t.Error("stored a file below a file")
+				}
+			})
+
+			t.Run("list", func(t *testing.T) {
+				s := open(t)
+				for _, n := range []string{"b.txt", "a/x.txt", "a/y/z.txt"} {
+					if _, err := put(t, s, "k", n, Meta{}, Overwrite, n); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err := s.Mkdir("empty", 0750); err != nil {
+					t.Fatal(err)
+				}
+				p, _ := s.Create("unfinished")
+				p.Close()
+
+				all, err := s.List("")
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := []string{"a", "a/x.txt", "a/y", "a/y/z.txt", "b.txt", "empty"}
+				if !reflect.DeepEqual(names(all), want) {
+					t.Errorf("List(\"\") = %q, want %q", names(all), want)
+				}
+				if l, err := s.List("a"); err != nil || !reflect.DeepEqual(names(l), []string{"a/x.txt", "a/y", "a/y/z.txt"}) {
+					t.Errorf("List(a) = %q, %v", names(l), err)
+				}
+				if l, err := s.List("b.txt"); err != nil || !reflect.DeepEqual(names(l), []string{"b.txt"}) {
+					t.Errorf("List(b.txt) = %q, %v", names(l), err)
+				}
+				if fi, err := s.Stat("empty"); err != nil || fi.Mode != fs.ModeDir|0750 {
+					t.Errorf("empty is %+v, %v", fi, err)
+				}
+				if _, err := s.List("nope"); !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("List(nope) = %v", err)
+				}
+			})
+
+			t.Run("open and remove", func(t *testing.T) {
+				s := open(t)
+				if _, err := put(t, s, "k", "d/f", Meta{}, Overwrite, "x"); err != nil {
+					t.Fatal(err)
+				}
+				if _, _, err := s.Open("d"); err == nil {
+					t.Error("opened a directory")
+				}
+				if _, _, err := s.Open("nope"); !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("Open(nope) = %v", err)
+				}
+				if err := s.Remove("d"); err == nil {
+					t.Error("removed a directory that is not empty")
+				}
+				for _, n := range []string{"d/f", "d"} {
+					if err := s.Remove(n); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err := s.Remove("d"); !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("Remove of a removed directory = %v", err)
+				}
+				if l, err := s.List(""); err != nil || len(l) != 0 {
+					t.Errorf("left %q, %v", names(l), err)
+				}
+			})
+
+			t.Run("names", func(t *testing.T) {
+				s := open(t)
+				for _, n := range []string{"../x", "/etc/x", "a/../../x", ".partial/x", "."} {
+					if _, err := put(t, s, "k", n, Meta{}, Overwrite, "x"); err == nil {
+						t.Errorf("stored %q", n)
+					}
+					if err := s.Remove(n); err == nil {
+						t.Errorf("removed %q", n)
+					}
+				}
+				if _, err := s.Create("../k"); err == nil {
+					t.Error("created a partial upload outside the store")
+				}
+			})
+		})
+	}
+}
+
+func TestCASDeduplicates(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewCAS(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects := func() int {
+		entries, err := os.ReadDir(filepath.Join(dir, casObjects))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(entries)
+	}
+	for _, n := range []string{"a.txt", "copy/a.txt"} {
+		if _, err := put(t, s, "k", n, Meta{}, Overwrite, "same"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := put(t, s, "k", "b.txt", Meta{}, Overwrite, "other"); err != nil {
+		t.Fatal(err)
+	}
+	if n := objects(); n != 2 {
+		t.Errorf("%d objects for two distinct contents", n)
+	}
+
+	// The index survives a restart.
+	if s, err = NewCAS(dir); err != nil {
+		t.Fatal(err)
+	}
+	if got := content(t, s, "copy/a.txt"); got != "same" {
+		t.Errorf("copy/a.txt = %q after reopening", got)
+	}
+
+	if err := s.Remove("a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got := content(t, s, "copy/a.txt"); got != "same" {
+		t.Errorf("copy/a.txt = %q after removing a.txt", got)
+	}
+	// Overwriting the last name of an object drops it, as does removing it.
+	if _, err := put(t, s, "k", "copy/a.txt", Meta{}, Overwrite, "changed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Remove("b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if n := objects(); n != 1 {
+		t.Errorf("%d objects for one content", n)
+	}
+}
+
+// TestFSSymlink checks that a symlink inside the directory cannot lead a
+// commit out of it.
+func TestFSSymlink(t *testing.T) {
+	dir, outside := t.TempDir(), t.TempDir()
+	s, err := NewFS(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := os.Symlink(outside, filepath.Join(dir, "link")); err != nil {
+		t.Skip(err)
+	}
+	if _, err := put(t, s, "k", "link/x", Meta{}, Overwrite, "x"); err == nil {
+		t.Error("committed through a symlink")
+	}
+	if entries, _ := os.ReadDir(outside); len(entries) != 0 {
+		t.Errorf("%d files written outside the store", len(entries))
+	}
+}
+
+func TestSuffixed(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		i    int
+		want string
+	}{
+		{"report.pdf", 0, "report.pdf"},
+		{"report.pdf", 1, "report-1.pdf"},
+		{"a/b/archive.tar.gz", 2, "a/b/archive.tar-2.gz"},
+		{".profile", 3, ".profile-3"},
+		{"README", 4, "README-4"},
+	} {
+		if got := Suffixed(tc.name, tc.i); got != tc.want {
+			t.Errorf("Suffixed(%q, %d) = %q, want %q", tc.name, tc.i, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// tree is the namespace of the stores that do not keep files under their
+// names, mapping each stored name to what it holds. Directories are nodes
+// of their own; the stores guard a tree with their lock.
+type tree map[string]*node
+
+type node struct {
+	Mode    fs.FileMode `json:"mode"`
+	Size    int64       `json:"size,omitempty"`
+	ModTime time.Time   `json:"mtime"`
+	// Hash names the object of a file in a CAS.
+	Hash string `json:"hash,omitempty"`
+	// data is the content of a file in a Memory store.
+	data []byte
+}
+
+func (n *node) info(name string) Info {
+	return Info{Name: name, Size: n.Size, Mode: n.Mode, ModTime: n.ModTime}
+}
+
+func notExist(op, name string) error {
+	return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
+
+// lookup returns the node of name, with "" standing for the store itself.
+func (t tree) lookup(op, name string) (string, *node, error) {
+	if name == "" {
+		return "", &node{Mode: fs.ModeDir | 0755}, nil
+	}
+	name, err := CleanName(name)
+	if err != nil {
+		return "", nil, err
+	}
+	n, ok := t[name]
+	if !ok {
+		return "", nil, notExist(op, name)
+	}
+	return name, n, nil
+}
+
+func (t tree) stat(name string) (Info, error) {
+	name, n, err := t.lookup("stat", name)
+	if err != nil {
+		return Info{}, err
+	}
+	return n.info(name), nil
+}
+
+func (t tree) list(name string) ([]Info, error) {
+	name, n, err := t.lookup("list", name)
+	if err != nil {
+		return nil, err
+	}
+	if !n.Mode.IsDir() {
+		return []Info{n.info(name)}, nil
+	}
+	var infos []Info
+	for p, n := range t {
+		if name == "" || strings.HasPrefix(p, name+"/") {
+			infos = append(infos, n.info(p))
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+// mkdirAll adds name and the directories above it that are missing.
+func (t tree) mkdirAll(name string, perm fs.FileMode) error {
+	if name == "." {
+		return nil
+	}
+	if n, ok := t[name]; ok {
+		if !n.Mode.IsDir() {
+			return &fs.PathError{Op: "mkdir", Path: name, Err: errors.New("not a directory")}
+		}
+		return nil
+	}
+	if err := t.mkdirAll(path.Dir(name), 0755); err != nil {
+		return err
+	}
+	t[name] = &node{Mode: fs.ModeDir | perm.Perm(), ModTime: time.Now()}
+	return nil
+}
+
+// place decides the name a file committed as name is stored under and
+// makes the directories above it. It returns the node the file replaces,
+// if any.
+func (t tree) place(name string, policy Policy) (string, *node, error) {
+	name, err := CleanName(name)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := t.mkdirAll(path.Dir(name), 0755); err != nil {
+		return "", nil, err
+	}
+	name, err = policy.pick(name, func(n string) bool { _, ok := t[n]; return ok })
+	if err != nil {
+		return "", nil, err
+	}
+	old := t[name]
+	if old != nil && old.Mode.IsDir() {
+		return "", nil, &fs.PathError{Op: "commit", Path: name, Err: ErrIsDir}
+	}
+	return name, old, nil
+}
+
+// remove deletes a file or an empty directory and returns it.
+func (t tree) remove(name string) (string, *node, error) {
+	if _, err := CleanName(name); err != nil {
+		return "", nil, err
+	}
+	name, n, err := t.lookup("remove", name)
+	if err != nil {
+		return "", nil, err
+	}
+	if n.Mode.IsDir() {
+		for p := range t {
+			if strings.HasPrefix(p, name+"/") {
+				return "", nil, &fs.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+			}
+		}
+	}
+	delete(t, name)
+	return name, n, nil
+}